@@ -0,0 +1,156 @@
+package main
+
+import (
+	"time"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Tags recording which instance is about to attach a volume. Instances
+// booting at the same time find the same volumes, so they claim a volume
+// before attaching it and move on to other volumes claimed by someone else.
+const (
+	claimedByTag = "claimed-by"
+	claimedAtTag = "claimed-at"
+	// releasedTag records when the volume was detached and released.
+	releasedTag = "released"
+)
+
+func (awsAsgEbs *AwsAsgEbs) instanceId() string {
+	return awsAsgEbs.InstanceId
+}
+
+// volumeClaimer finds volumes and claims them for this instance. It counts
+// the API calls made for claiming, and skips volumes which could not be
+// attached after claiming them.
+type volumeClaimer struct {
+	asgEbs   AsgEbs
+	cfg      Config
+	skipped  map[string]bool
+	apiCalls int
+}
+
+func newVolumeClaimer(asgEbs AsgEbs, cfg Config) *volumeClaimer {
+	return &volumeClaimer{asgEbs: asgEbs, cfg: cfg, skipped: map[string]bool{}}
+}
+
+func (c *volumeClaimer) enabled() bool {
+	return *c.cfg.claimTtl > 0
+}
+
+// claimedByOther tells whether the tags hold a claim of another instance,
+// which has not expired yet and was not followed by a release.
+func (c *volumeClaimer) claimedByOther(tags map[string]string, now time.Time) bool {
+	claimedBy := tags[claimedByTag]
+	if claimedBy == "" || claimedBy == c.asgEbs.instanceId() {
+		return false
+	}
+	claimedAt, err := time.Parse(time.RFC3339Nano, tags[claimedAtTag])
+	if err != nil {
+		return false
+	}
+	released, err := time.Parse(time.RFC3339, tags[releasedTag])
+	if err == nil && released.After(claimedAt) {
+		return false
+	}
+	return now.Sub(claimedAt) < *c.cfg.claimTtl
+}
+
+// claimTags are the tags claiming a volume for the instance.
+func claimTags(instanceId string, now time.Time) map[string]string {
+	return map[string]string{claimedByTag: instanceId, claimedAtTag: now.Format(time.RFC3339Nano)}
+}
+
+// claim tags the volume with the instance id and the current time, waits for
+// competing claims to be written, and reads the tags back to see whether it
+// won. Volumes claimed by another instance within the TTL are left alone.
+func (c *volumeClaimer) claim(volumeId string) (bool, error) {
+	c.apiCalls++
+	tags, err := c.asgEbs.volumeTags(volumeId)
+	if err != nil {
+		return false, err
+	}
+	now := time.Now().UTC()
+	if c.claimedByOther(tags, now) {
+		log.WithFields(log.Fields{"volume": volumeId, "claimed_by": tags[claimedByTag], "claimed_at": tags[claimedAtTag]}).Info("Volume is claimed by another instance")
+		return false, nil
+	}
+
+	claim := claimTags(c.asgEbs.instanceId(), now)
+	c.apiCalls++
+	err = c.asgEbs.tagVolume(volumeId, claim)
+	if err != nil {
+		return false, err
+	}
+
+	time.Sleep(*c.cfg.claimDelay)
+
+	c.apiCalls++
+	tags, err = c.asgEbs.volumeTags(volumeId)
+	if err != nil {
+		return false, err
+	}
+	if tags[claimedByTag] != claim[claimedByTag] || tags[claimedAtTag] != claim[claimedAtTag] {
+		log.WithFields(log.Fields{"volume": volumeId, "claimed_by": tags[claimedByTag]}).Info("Lost claim of volume to another instance")
+		return false, nil
+	}
+	return true, nil
+}
+
+// findVolume returns the first volume this instance could claim, or nil if
+// all are claimed by other instances. Without a claim TTL, the first volume found is used as is.
+func (c *volumeClaimer) findVolume() (*string, error) {
+	if !c.enabled() {
+		return c.asgEbs.findVolume(*c.cfg.tagKey, *c.cfg.tagValue)
+	}
+
+	c.apiCalls++
+	volumes, err := c.asgEbs.findVolumes(*c.cfg.tagKey, *c.cfg.tagValue)
+	if err != nil {
+		return nil, err
+	}
+	return c.claimVolume(volumes)
+}
+
+// claimVolume returns the first of the volumes this instance could claim, or
+// nil if all are claimed by other instances. Without a claim TTL, the first
+// volume is used as is.
+func (c *volumeClaimer) claimVolume(volumes []*ec2.Volume) (*string, error) {
+	if !c.enabled() {
+		if len(volumes) == 0 {
+			return nil, nil
+		}
+		return volumes[0].VolumeId, nil
+	}
+
+	var claimErr error
+	for _, volume := range volumes {
+		volumeId := *volume.VolumeId
+		if c.skipped[volumeId] {
+			continue
+		}
+		claimed, err := c.claim(volumeId)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": volumeId}).Warn("Failed to claim volume")
+			claimErr = err
+			continue
+		}
+		if claimed {
+			log.WithFields(log.Fields{"volume": volumeId, "claim_api_calls": c.apiCalls}).Info("Claimed volume")
+			return &volumeId, nil
+		}
+	}
+	// Creating a new volume because claiming failed would leave the
+	// existing ones unused.
+	return nil, claimErr
+}
+
+// skip excludes a claimed volume which could not be attached from being
+// claimed again.
+func (c *volumeClaimer) skip(volumeId string) {
+	if c.enabled() {
+		c.skipped[volumeId] = true
+	}
+}
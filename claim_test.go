@@ -0,0 +1,191 @@
+package main
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// withVolumeTags makes the fake keep the tags of the volume, so tags written
+// by tagVolume are returned by volumeTags. Competing claims are written after
+// the ones of this instance if given.
+func withVolumeTags(fakeAsgEbs *FakeAsgEbs, volumeId string, tags map[string]string, competingClaim map[string]string) {
+	fakeAsgEbs.
+		On("volumeTags", volumeId).
+		Return(tags, nil)
+	fakeAsgEbs.
+		On("tagVolume", volumeId, mock.AnythingOfType("map[string]string")).
+		Run(func(args mock.Arguments) {
+			for key, value := range args.Get(1).(map[string]string) {
+				tags[key] = value
+			}
+			for key, value := range competingClaim {
+				tags[key] = value
+			}
+		}).
+		Return(nil)
+}
+
+func newClaimConfig() *Config {
+	cfg := newConfig()
+	cfg.claimTtl = durationPtr(2 * time.Minute)
+	return cfg
+}
+
+func volumeList(volumeIds ...string) []*ec2.Volume {
+	volumes := []*ec2.Volume{}
+	for _, volumeId := range volumeIds {
+		volumes = append(volumes, &ec2.Volume{VolumeId: aws.String(volumeId)})
+	}
+	return volumes
+}
+
+func TestClaimVolume(t *testing.T) {
+	cfg := newClaimConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	tags := map[string]string{fileSystemTypeTag: "ext4"}
+
+	fakeAsgEbs.
+		On("findVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(volumeList(defaultVolumeId), nil)
+	withVolumeTags(fakeAsgEbs, defaultVolumeId, tags, nil)
+
+	claimer := newVolumeClaimer(fakeAsgEbs, *cfg)
+	volumeId, err := claimer.findVolume()
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultVolumeId, *volumeId)
+	assert.Equal(t, defaultInstanceId, tags[claimedByTag])
+	assert.Equal(t, 4, claimer.apiCalls)
+}
+
+func TestSkipVolumeClaimedByOtherInstance(t *testing.T) {
+	cfg := newClaimConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	otherVolumeId := "vol-123457"
+
+	fakeAsgEbs.
+		On("findVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(volumeList(defaultVolumeId, otherVolumeId), nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{claimedByTag: "i-654321", claimedAtTag: time.Now().Add(-time.Minute).UTC().Format(time.RFC3339Nano)}, nil)
+	withVolumeTags(fakeAsgEbs, otherVolumeId, map[string]string{}, nil)
+
+	claimer := newVolumeClaimer(fakeAsgEbs, *cfg)
+	volumeId, err := claimer.findVolume()
+
+	assert.NoError(t, err)
+	assert.Equal(t, otherVolumeId, *volumeId)
+	fakeAsgEbs.AssertNotCalled(t, "tagVolume", defaultVolumeId, mock.AnythingOfType("map[string]string"))
+	assert.Equal(t, 5, claimer.apiCalls)
+}
+
+func TestClaimVolumeWithStaleClaim(t *testing.T) {
+	cfg := newClaimConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	tags := map[string]string{claimedByTag: "i-654321", claimedAtTag: time.Now().Add(-time.Hour).UTC().Format(time.RFC3339Nano)}
+
+	fakeAsgEbs.
+		On("findVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(volumeList(defaultVolumeId), nil)
+	withVolumeTags(fakeAsgEbs, defaultVolumeId, tags, nil)
+
+	claimer := newVolumeClaimer(fakeAsgEbs, *cfg)
+	volumeId, err := claimer.findVolume()
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultVolumeId, *volumeId)
+	assert.Equal(t, defaultInstanceId, tags[claimedByTag])
+}
+
+func TestClaimReleasedVolume(t *testing.T) {
+	cfg := newClaimConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	now := time.Now().UTC()
+	tags := map[string]string{
+		claimedByTag: "i-654321",
+		claimedAtTag: now.Add(-time.Minute).Format(time.RFC3339Nano),
+		releasedTag:  now.Format(time.RFC3339),
+	}
+
+	fakeAsgEbs.
+		On("findVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(volumeList(defaultVolumeId), nil)
+	withVolumeTags(fakeAsgEbs, defaultVolumeId, tags, nil)
+
+	claimer := newVolumeClaimer(fakeAsgEbs, *cfg)
+	volumeId, err := claimer.findVolume()
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultVolumeId, *volumeId)
+	assert.Equal(t, defaultInstanceId, tags[claimedByTag])
+}
+
+func TestNoVolumeIfAllAreClaimed(t *testing.T) {
+	cfg := newClaimConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	competingClaim := map[string]string{claimedByTag: "i-654321", claimedAtTag: time.Now().UTC().Format(time.RFC3339Nano)}
+
+	fakeAsgEbs.
+		On("findVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(volumeList(defaultVolumeId), nil)
+	withVolumeTags(fakeAsgEbs, defaultVolumeId, map[string]string{}, competingClaim)
+
+	claimer := newVolumeClaimer(fakeAsgEbs, *cfg)
+	volumeId, err := claimer.findVolume()
+
+	assert.NoError(t, err)
+	assert.Nil(t, volumeId)
+}
+
+func TestClaimErrorDoesNotCreateVolume(t *testing.T) {
+	cfg := newClaimConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(volumeList(defaultVolumeId), nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{}, errors.New("RequestLimitExceeded"))
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+}
+
+func TestAttachVolumeAfterLosingClaim(t *testing.T) {
+	cfg := newClaimConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	otherVolumeId := "vol-123457"
+	competingClaim := map[string]string{claimedByTag: "i-654321", claimedAtTag: time.Now().UTC().Format(time.RFC3339Nano)}
+
+	fakeAsgEbs.
+		On("findVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(volumeList(defaultVolumeId, otherVolumeId), nil)
+	withVolumeTags(fakeAsgEbs, defaultVolumeId, map[string]string{fileSystemTypeTag: "ext4"}, competingClaim)
+	withVolumeTags(fakeAsgEbs, otherVolumeId, map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("attachVolume", otherVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("describeVolume", otherVolumeId).
+		Return(&ec2.Volume{Size: aws.Int64(200)}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 1)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", otherVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// createdForTag records the tag pair a volume was created for. Instances
+// which find no volume at the same time all create one, so they compare the
+// volumes created for the same tag pair and only keep the first one.
+const createdForTag = "created-for"
+
+// createdFor identifies what a volume was created for, the tag pair and the
+// slot in slot mode, as volumes of different slots are no duplicates.
+func createdFor(cfg Config, slot int) string {
+	if slot == noSlot {
+		return *cfg.tagKey + "=" + *cfg.tagValue
+	}
+	return fmt.Sprintf("%s=%s/%s=%d", *cfg.tagKey, *cfg.tagValue, slotTag, slot)
+}
+
+// creationTags adds the slot and, if concurrent creations are deduplicated,
+// the created-for tag to the tags of new volumes. Creations for a slot are
+// always deduplicated, and unless the claim TTL is 0 the new volume claims
+// the slot for this instance until it is attached and formatted here.
+func creationTags(asgEbs AsgEbs, cfg Config, createTags map[string]string, slot int) map[string]string {
+	if *cfg.creationWindow <= 0 && slot == noSlot {
+		return createTags
+	}
+	tags := map[string]string{}
+	for key, value := range createTags {
+		tags[key] = value
+	}
+	if *cfg.creationWindow > 0 || slot != noSlot {
+		tags[createdForTag] = createdFor(cfg, slot)
+	}
+	if slot != noSlot {
+		tags[slotTag] = strconv.Itoa(slot)
+	}
+	if slot != noSlot && *cfg.claimTtl > 0 {
+		for key, value := range claimTags(asgEbs.instanceId(), time.Now().UTC()) {
+			tags[key] = value
+		}
+	}
+	return tags
+}
+
+func (awsAsgEbs *AwsAsgEbs) findCreatedVolumes(createdFor string) ([]*ec2.Volume, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	params := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("tag:" + createdForTag),
+				Values: []*string{
+					aws.String(createdFor),
+				},
+			},
+			{
+				Name: aws.String("status"),
+				Values: []*string{
+					aws.String("creating"),
+					aws.String("available"),
+					aws.String("in-use"),
+				},
+			},
+			{
+				Name: aws.String("availability-zone"),
+				Values: []*string{
+					aws.String(awsAsgEbs.AvailabilityZone),
+				},
+			},
+		},
+	}
+
+	describeVolumesOutput, err := svc.DescribeVolumes(params)
+	if err != nil {
+		return nil, err
+	}
+	return describeVolumesOutput.Volumes, nil
+}
+
+// ByCreateTime orders volumes by creation time, and by id if they were
+// created at the same time.
+type ByCreateTime []*ec2.Volume
+
+func (v ByCreateTime) Len() int      { return len(v) }
+func (v ByCreateTime) Swap(i, j int) { v[i], v[j] = v[j], v[i] }
+func (v ByCreateTime) Less(i, j int) bool {
+	if !v[i].CreateTime.Equal(*v[j].CreateTime) {
+		return v[i].CreateTime.Before(*v[j].CreateTime)
+	}
+	return *v[i].VolumeId < *v[j].VolumeId
+}
+
+// electCreatedVolume picks the volume to keep among the volumes created
+// within the window around the given one, which is the first one created.
+// Without a window all the volumes are compared. The given volume is taken
+// as created now if it is not listed yet.
+func electCreatedVolume(volumes []*ec2.Volume, volumeId string, window time.Duration, now time.Time) string {
+	created := now
+	for _, volume := range volumes {
+		if *volume.VolumeId == volumeId {
+			created = *volume.CreateTime
+		}
+	}
+
+	candidates := []*ec2.Volume{{VolumeId: aws.String(volumeId), CreateTime: &created}}
+	for _, volume := range volumes {
+		if *volume.VolumeId == volumeId {
+			continue
+		}
+		if window <= 0 || volume.CreateTime.After(created.Add(-window)) && volume.CreateTime.Before(created.Add(window)) {
+			candidates = append(candidates, volume)
+		}
+	}
+	sort.Sort(ByCreateTime(candidates))
+	return *candidates[0].VolumeId
+}
+
+// deduplicateCreation waits for competing instances to create their volumes
+// for the same tag pair and keeps only the first one. If another instance
+// won, the new volume is deleted and false returned, as the volume of the
+// other instance is attached there. A slot only has room for one volume, so
+// volumes created for it are compared regardless of the window.
+func deduplicateCreation(asgEbs AsgEbs, cfg Config, volumeId string, slot int) (bool, error) {
+	window := *cfg.creationWindow
+	if slot != noSlot {
+		window = 0
+	} else if window <= 0 {
+		return true, nil
+	}
+
+	time.Sleep(*cfg.claimDelay)
+
+	volumes, err := asgEbs.findCreatedVolumes(createdFor(cfg, slot))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "created_for": createdFor(cfg, slot)}).Error("Failed to find volumes created concurrently")
+		return false, err
+	}
+	winner := electCreatedVolume(volumes, volumeId, window, time.Now())
+	if winner == volumeId {
+		return true, nil
+	}
+
+	log.WithFields(log.Fields{"volume": volumeId, "kept_volume": winner}).Warn("Another instance created a volume at the same time, deleting the new volume")
+	err = asgEbs.deleteVolume(volumeId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to delete duplicate volume")
+		return false, err
+	}
+	return false, nil
+}
@@ -0,0 +1,170 @@
+package main
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// fakeVolumeStore keeps the volumes created by several racing instances.
+type fakeVolumeStore struct {
+	sync.Mutex
+	volumes []*ec2.Volume
+	created time.Time
+}
+
+// racingAsgEbs is an instance creating its volume in the store shared with
+// other instances.
+type racingAsgEbs struct {
+	*FakeAsgEbs
+	store    *fakeVolumeStore
+	volumeId string
+}
+
+func (r *racingAsgEbs) createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string, options VolumeOptions) (*string, error) {
+	r.FakeAsgEbs.createVolume(createSize, createName, createVolumeType, createTags, snapshotId, options)
+	r.store.Lock()
+	defer r.store.Unlock()
+	r.store.created = r.store.created.Add(time.Second)
+	createTime := r.store.created
+	r.store.volumes = append(r.store.volumes, &ec2.Volume{VolumeId: aws.String(r.volumeId), CreateTime: &createTime})
+	return aws.String(r.volumeId), nil
+}
+
+func (r *racingAsgEbs) findCreatedVolumes(createdFor string) ([]*ec2.Volume, error) {
+	r.FakeAsgEbs.findCreatedVolumes(createdFor)
+	r.store.Lock()
+	defer r.store.Unlock()
+	return append([]*ec2.Volume{}, r.store.volumes...), nil
+}
+
+func newRacingAsgEbs(store *fakeVolumeStore, volumeId string) *racingAsgEbs {
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(volumeId, nil)
+	fakeAsgEbs.
+		On("findCreatedVolumes", mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{}, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", volumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("deleteVolume", volumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", volumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), volumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", volumeId, map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+	return &racingAsgEbs{FakeAsgEbs: fakeAsgEbs, store: store, volumeId: volumeId}
+}
+
+func TestElectCreatedVolume(t *testing.T) {
+	now := time.Date(2020, 1, 1, 12, 0, 0, 0, time.UTC)
+	at := func(d time.Duration) *time.Time {
+		createTime := now.Add(d)
+		return &createTime
+	}
+	volumes := []*ec2.Volume{
+		{VolumeId: aws.String("vol-1"), CreateTime: at(-time.Hour)},
+		{VolumeId: aws.String("vol-3"), CreateTime: at(-2 * time.Second)},
+		{VolumeId: aws.String("vol-2"), CreateTime: at(-2 * time.Second)},
+		{VolumeId: aws.String("vol-4"), CreateTime: at(-time.Second)},
+	}
+
+	assert.Equal(t, "vol-2", electCreatedVolume(volumes, "vol-4", time.Minute, now))
+	assert.Equal(t, "vol-2", electCreatedVolume(volumes, "vol-3", time.Minute, now))
+	assert.Equal(t, "vol-1", electCreatedVolume(volumes, "vol-1", time.Minute, now))
+	// Volumes not listed yet count as created now.
+	assert.Equal(t, "vol-2", electCreatedVolume(volumes, "vol-5", time.Minute, now))
+	assert.Equal(t, "vol-5", electCreatedVolume(volumes[:1], "vol-5", time.Minute, now))
+	// Without a window, volumes created long before still win.
+	assert.Equal(t, "vol-1", electCreatedVolume(volumes, "vol-4", 0, now))
+}
+
+func TestCreationTags(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	cfg.createTags = &map[string]string{"team": "my-team"}
+	assert.Equal(t, map[string]string{"team": "my-team"}, creationTags(fakeAsgEbs, *cfg, *cfg.createTags, noSlot))
+
+	cfg.creationWindow = durationPtr(time.Minute)
+	assert.Equal(t, map[string]string{"team": "my-team", createdForTag: *cfg.tagKey + "=" + *cfg.tagValue}, creationTags(fakeAsgEbs, *cfg, *cfg.createTags, noSlot))
+	assert.Equal(t, map[string]string{"team": "my-team"}, *cfg.createTags)
+}
+
+func TestCreationTagsClaimSlot(t *testing.T) {
+	cfg := newConfig()
+	cfg.claimTtl = durationPtr(2 * time.Minute)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	tags := creationTags(fakeAsgEbs, *cfg, map[string]string{}, 2)
+
+	assert.Equal(t, "2", tags[slotTag])
+	assert.Equal(t, createdFor(*cfg, 2), tags[createdForTag])
+	assert.Equal(t, defaultInstanceId, tags[claimedByTag])
+	assert.NotEmpty(t, tags[claimedAtTag])
+
+	cfg.claimTtl = durationPtr(0)
+	tags = creationTags(fakeAsgEbs, *cfg, map[string]string{}, 2)
+
+	assert.Equal(t, "2", tags[slotTag])
+	assert.NotContains(t, tags, claimedByTag)
+}
+
+func TestDeduplicateConcurrentCreation(t *testing.T) {
+	cfg := newConfig()
+	cfg.creationWindow = durationPtr(time.Minute)
+	// Long enough for all instances to create their volume before any of
+	// them looks for the others.
+	cfg.claimDelay = durationPtr(100 * time.Millisecond)
+
+	store := &fakeVolumeStore{created: time.Now()}
+	instances := []*racingAsgEbs{
+		newRacingAsgEbs(store, "vol-1"),
+		newRacingAsgEbs(store, "vol-2"),
+		newRacingAsgEbs(store, "vol-3"),
+	}
+
+	errs := make([]error, len(instances))
+	var wg sync.WaitGroup
+	for i, instance := range instances {
+		wg.Add(1)
+		go func(i int, instance *racingAsgEbs) {
+			defer wg.Done()
+			errs[i] = runAsgEbs(instance, *cfg)
+		}(i, instance)
+	}
+	wg.Wait()
+
+	winner := *store.volumes[0].VolumeId
+	for i, instance := range instances {
+		instance.AssertNumberOfCalls(t, "createVolume", 1)
+		if instance.volumeId == winner {
+			assert.NoError(t, errs[i])
+			instance.AssertNumberOfCalls(t, "deleteVolume", 0)
+			instance.AssertCalled(t, "attachVolume", winner, *cfg.attachAs, *cfg.deleteOnTermination)
+		} else {
+			assert.Error(t, errs[i])
+			instance.AssertCalled(t, "deleteVolume", instance.volumeId)
+			instance.AssertNumberOfCalls(t, "attachVolume", 0)
+		}
+	}
+}
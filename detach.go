@@ -0,0 +1,155 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func (awsAsgEbs *AwsAsgEbs) findAttachedVolume(attachAs string) (*string, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	params := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("attachment.instance-id"),
+				Values: []*string{
+					aws.String(awsAsgEbs.InstanceId),
+				},
+			},
+			{
+				Name: aws.String("attachment.device"),
+				Values: []*string{
+					aws.String(attachAs),
+				},
+			},
+		},
+	}
+
+	describeVolumesOutput, err := svc.DescribeVolumes(params)
+	if err != nil {
+		return nil, err
+	}
+	if len(describeVolumesOutput.Volumes) == 0 {
+		return nil, nil
+	}
+	return describeVolumesOutput.Volumes[0].VolumeId, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) unmountVolume(mountPoint string) error {
+	err := run("/bin/sync")
+	if err != nil {
+		return err
+	}
+	return run("/bin/umount", mountPoint)
+}
+
+func (awsAsgEbs *AwsAsgEbs) detachVolume(volumeId string, attachAs string) error {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	detachVolumeInput := &ec2.DetachVolumeInput{
+		VolumeId:   aws.String(volumeId),
+		InstanceId: aws.String(awsAsgEbs.InstanceId),
+	}
+	if attachAs != "" {
+		detachVolumeInput.Device = aws.String(attachAs)
+	}
+	_, err := svc.DetachVolume(detachVolumeInput)
+	return err
+}
+
+type DetachConfig struct {
+	attachAs   *string
+	mountPoint *string
+}
+
+// attachedVolumes returns the volumes below the mounted device with the
+// device names they are attached as. Members of RAID arrays and volume groups
+// are detached without a device name, as it may differ from their block
+// device on NVMe instances.
+func attachedVolumes(asgEbs AsgEbs, cfg DetachConfig, stack DeviceStack) (map[string]string, error) {
+	if len(stack.Layers) == 0 {
+		volumeId, err := asgEbs.findAttachedVolume(*cfg.attachAs)
+		if err != nil || volumeId == nil {
+			return nil, err
+		}
+		return map[string]string{*volumeId: *cfg.attachAs}, nil
+	}
+
+	volumes := map[string]string{}
+	for _, member := range stack.Members {
+		volumeId, err := asgEbs.findDeviceVolume(member)
+		if err != nil {
+			return nil, err
+		}
+		if volumeId == nil {
+			return nil, fmt.Errorf("no volume found for device %s", member)
+		}
+		volumes[*volumeId] = ""
+	}
+	return volumes, nil
+}
+
+func runDetach(asgEbs AsgEbs, cfg DetachConfig) {
+	stack, err := asgEbs.deviceStack(*cfg.mountPoint)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "mount_point": *cfg.mountPoint}).Fatal("Failed to find mounted device")
+	}
+	volumes, err := attachedVolumes(asgEbs, cfg, stack)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Failed to find attached volume")
+	}
+	if volumes == nil {
+		log.WithFields(log.Fields{"device": *cfg.attachAs}).Fatal("No volume attached")
+	}
+
+	log.WithFields(log.Fields{"mount_point": *cfg.mountPoint}).Info("Unmounting volume")
+	err = asgEbs.unmountVolume(*cfg.mountPoint)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Failed to unmount volume")
+	}
+
+	for _, layer := range stack.Layers {
+		log.WithFields(log.Fields{"device": layer}).Info("Closing device")
+		err = asgEbs.closeDevice(layer)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "device": layer}).Fatal("Failed to close device")
+		}
+	}
+
+	for volumeId, attachAs := range volumes {
+		releaseVolume(asgEbs, volumeId, attachAs)
+	}
+}
+
+// releaseVolume detaches the volume and marks it as released.
+func releaseVolume(asgEbs AsgEbs, volumeId string, attachAs string) {
+	log.WithFields(log.Fields{"volume": volumeId, "device": attachAs}).Info("Detaching volume")
+	err := asgEbs.detachVolume(volumeId, attachAs)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Failed to detach volume")
+	}
+
+	log.WithFields(log.Fields{"volume": volumeId}).Info("Waiting until volume is available")
+	err = asgEbs.waitUntilVolumeAvailable(volumeId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Fatal("Waiting for volume timed out")
+	}
+
+	err = asgEbs.tagVolume(volumeId, map[string]string{releasedTag: time.Now().UTC().Format(time.RFC3339)})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Fatal("Failed to tag volume as released")
+	}
+
+	// Without a claim, the next instance picks up the volume right away
+	// instead of waiting for the claim TTL to expire.
+	err = asgEbs.untagVolume(volumeId, []string{claimedByTag, claimedAtTag})
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Fatal("Failed to remove claim of released volume")
+	}
+}
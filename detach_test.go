@@ -0,0 +1,102 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/mock"
+)
+
+func newDetachConfig() *DetachConfig {
+	return &DetachConfig{
+		attachAs:   strPtr("xvdc"),
+		mountPoint: strPtr("/mnt"),
+	}
+}
+
+func TestDetachAttachedVolume(t *testing.T) {
+	cfg := newDetachConfig()
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("deviceStack", *cfg.mountPoint).
+		Return(DeviceStack{Device: "/dev/xvdc", Members: []string{"/dev/xvdc"}}, nil)
+	fakeAsgEbs.
+		On("findAttachedVolume", mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("unmountVolume", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("detachVolume", defaultVolumeId, mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, mock.AnythingOfType("map[string]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("untagVolume", defaultVolumeId, mock.AnythingOfType("[]string")).
+		Return(nil)
+
+	runDetach(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertCalled(t, "findAttachedVolume", *cfg.attachAs)
+	fakeAsgEbs.AssertCalled(t, "unmountVolume", *cfg.mountPoint)
+	fakeAsgEbs.AssertCalled(t, "detachVolume", defaultVolumeId, *cfg.attachAs)
+	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeAvailable", defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "tagVolume", defaultVolumeId, mock.MatchedBy(func(tags map[string]string) bool {
+		_, ok := tags[releasedTag]
+		return ok
+	}))
+	fakeAsgEbs.AssertCalled(t, "untagVolume", defaultVolumeId, []string{claimedByTag, claimedAtTag})
+	fakeAsgEbs.AssertNumberOfCalls(t, "closeDevice", 0)
+}
+
+func TestDetachVolumeGroupOnRaidMembers(t *testing.T) {
+	cfg := newDetachConfig()
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("deviceStack", *cfg.mountPoint).
+		Return(DeviceStack{
+			Device:  "/dev/mapper/vg0-data",
+			Layers:  []string{"/dev/dm-0", "/dev/md0"},
+			Members: []string{"/dev/xvdf", "/dev/xvdg"},
+		}, nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdf").
+		Return("vol-0", nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdg").
+		Return("vol-1", nil)
+	fakeAsgEbs.
+		On("unmountVolume", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("closeDevice", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("detachVolume", mock.AnythingOfType("string"), "").
+		Return(nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("untagVolume", mock.AnythingOfType("string"), mock.AnythingOfType("[]string")).
+		Return(nil)
+
+	runDetach(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertNumberOfCalls(t, "findAttachedVolume", 0)
+	fakeAsgEbs.AssertCalled(t, "unmountVolume", *cfg.mountPoint)
+	fakeAsgEbs.AssertCalled(t, "closeDevice", "/dev/dm-0")
+	fakeAsgEbs.AssertCalled(t, "closeDevice", "/dev/md0")
+	fakeAsgEbs.AssertCalled(t, "detachVolume", "vol-0", "")
+	fakeAsgEbs.AssertCalled(t, "detachVolume", "vol-1", "")
+	fakeAsgEbs.AssertCalled(t, "untagVolume", "vol-0", []string{claimedByTag, claimedAtTag})
+	fakeAsgEbs.AssertCalled(t, "untagVolume", "vol-1", []string{claimedByTag, claimedAtTag})
+}
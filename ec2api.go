@@ -0,0 +1,78 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/url"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/ec2"
+)
+
+// newerApiVersion is the EC2 API version used for parameters and operations
+// which the vendored SDK does not know about yet.
+const newerApiVersion = "2016-11-15"
+
+// withQueryParams returns a build handler which adds the given parameters to
+// an EC2 query request and switches it to newerApiVersion.
+func withQueryParams(params url.Values) func(*request.Request) {
+	return func(r *request.Request) {
+		if r.Error != nil {
+			return
+		}
+		body, err := ioutil.ReadAll(r.Body)
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed reading EC2 Query request", err)
+			return
+		}
+		values, err := url.ParseQuery(string(body))
+		if err != nil {
+			r.Error = awserr.New("SerializationError", "failed parsing EC2 Query request", err)
+			return
+		}
+		values.Set("Version", newerApiVersion)
+		for k, v := range params {
+			values[k] = v
+		}
+		r.SetBufferBody([]byte(values.Encode()))
+	}
+}
+
+// volumeModification is an EC2 VolumeModification, reduced to the fields
+// asg-ebs needs.
+type volumeModification struct {
+	_ struct{} `type:"structure"`
+
+	VolumeId          *string `locationName:"volumeId" type:"string"`
+	ModificationState *string `locationName:"modificationState" type:"string"`
+	StatusMessage     *string `locationName:"statusMessage" type:"string"`
+	TargetSize        *int64  `locationName:"targetSize" type:"integer"`
+}
+
+type modifyVolumeOutput struct {
+	_ struct{} `type:"structure"`
+
+	VolumeModification *volumeModification `locationName:"volumeModification" type:"structure"`
+}
+
+type describeVolumesModificationsOutput struct {
+	_ struct{} `type:"structure"`
+
+	VolumesModifications []*volumeModification `locationName:"volumeModificationSet" locationNameList:"item" type:"list"`
+}
+
+type emptyQueryInput struct {
+	_ struct{} `type:"structure"`
+}
+
+// newerApiRequest returns a request for an EC2 operation which the vendored
+// SDK does not know about. All parameters are passed as query parameters.
+func newerApiRequest(svc *ec2.EC2, operation string, params url.Values, output interface{}) *request.Request {
+	req := svc.NewRequest(&request.Operation{
+		Name:       operation,
+		HTTPMethod: "POST",
+		HTTPPath:   "/",
+	}, &emptyQueryInput{}, output)
+	req.Handlers.Build.PushBack(withQueryParams(params))
+	return req
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/credentials"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestWithQueryParams(t *testing.T) {
+	svc := ec2.New(session.New(aws.NewConfig().
+		WithRegion("eu-west-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))))
+
+	req, _ := svc.CreateVolumeRequest(&ec2.CreateVolumeInput{
+		AvailabilityZone: aws.String("eu-west-1a"),
+		Size:             aws.Int64(100),
+		VolumeType:       aws.String("gp3"),
+	})
+	req.Handlers.Build.PushBack(withQueryParams(url.Values{"Throughput": {"500"}}))
+
+	assert.NoError(t, req.Build())
+	body, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	values, err := url.ParseQuery(string(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "CreateVolume", values.Get("Action"))
+	assert.Equal(t, newerApiVersion, values.Get("Version"))
+	assert.Equal(t, "gp3", values.Get("VolumeType"))
+	assert.Equal(t, "500", values.Get("Throughput"))
+}
+
+func TestNewerApiRequest(t *testing.T) {
+	svc := ec2.New(session.New(aws.NewConfig().
+		WithRegion("eu-west-1").
+		WithCredentials(credentials.NewStaticCredentials("id", "secret", ""))))
+
+	output := &describeVolumesModificationsOutput{}
+	req := newerApiRequest(svc, "DescribeVolumesModifications", url.Values{"VolumeId.1": {"vol-123456"}}, output)
+
+	assert.NoError(t, req.Build())
+	body, err := ioutil.ReadAll(req.Body)
+	assert.NoError(t, err)
+	values, err := url.ParseQuery(string(body))
+	assert.NoError(t, err)
+	assert.Equal(t, "DescribeVolumesModifications", values.Get("Action"))
+	assert.Equal(t, newerApiVersion, values.Get("Version"))
+	assert.Equal(t, "vol-123456", values.Get("VolumeId.1"))
+
+	req.HTTPResponse = &http.Response{
+		StatusCode: 200,
+		Body: ioutil.NopCloser(strings.NewReader(`<DescribeVolumesModificationsResponse xmlns="http://ec2.amazonaws.com/doc/2016-11-15/">
+  <volumeModificationSet>
+    <item>
+      <volumeId>vol-123456</volumeId>
+      <modificationState>optimizing</modificationState>
+      <targetSize>200</targetSize>
+    </item>
+  </volumeModificationSet>
+</DescribeVolumesModificationsResponse>`)),
+	}
+	req.Handlers.Unmarshal.Run(req)
+
+	assert.NoError(t, req.Error)
+	assert.Len(t, output.VolumesModifications, 1)
+	assert.Equal(t, "optimizing", *output.VolumesModifications[0].ModificationState)
+	assert.Equal(t, int64(200), *output.VolumesModifications[0].TargetSize)
+}
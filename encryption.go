@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func (awsAsgEbs *AwsAsgEbs) describeVolume(volumeId string) (*ec2.Volume, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	describeVolumesOutput, err := svc.DescribeVolumes(&ec2.DescribeVolumesInput{
+		VolumeIds: []*string{aws.String(volumeId)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(describeVolumesOutput.Volumes) == 0 {
+		return nil, fmt.Errorf("volume %s not found", volumeId)
+	}
+	return describeVolumesOutput.Volumes[0], nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) describeSnapshot(snapshotId string) (*ec2.Snapshot, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	describeSnapshotsOutput, err := svc.DescribeSnapshots(&ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotId)},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if len(describeSnapshotsOutput.Snapshots) == 0 {
+		return nil, fmt.Errorf("snapshot %s not found", snapshotId)
+	}
+	return describeSnapshotsOutput.Snapshots[0], nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) copySnapshot(snapshotId string, options VolumeOptions) (*string, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	copySnapshotInput := &ec2.CopySnapshotInput{
+		SourceRegion:     aws.String(awsAsgEbs.Region),
+		SourceSnapshotId: aws.String(snapshotId),
+		Description:      aws.String("Encrypted copy of " + snapshotId),
+		Encrypted:        aws.Bool(options.Encrypted),
+	}
+	if options.KmsKeyId != "" {
+		copySnapshotInput.KmsKeyId = aws.String(options.KmsKeyId)
+	}
+	copySnapshotOutput, err := svc.CopySnapshot(copySnapshotInput)
+	if err != nil {
+		return nil, err
+	}
+
+	snapshot, err := awsAsgEbs.describeSnapshot(snapshotId)
+	if err != nil {
+		return copySnapshotOutput.SnapshotId, err
+	}
+	err = tagResource(svc, *copySnapshotOutput.SnapshotId, copyTags(snapshot.Tags))
+	if err != nil {
+		return copySnapshotOutput.SnapshotId, err
+	}
+	return copySnapshotOutput.SnapshotId, nil
+}
+
+// copyTags returns the tags of the encrypted copy of a snapshot. Volumes
+// restored from the copy get the data tags of the original snapshot. Its Name
+// and the tags of the user are left out and the copy is marked transient, so
+// it is never taken for the newest snapshot when restoring or pruning.
+func copyTags(snapshotTags []*ec2.Tag) map[string]string {
+	tags := map[string]string{transientTag: "true"}
+	for _, tag := range snapshotTags {
+		if dataTagKeys[*tag.Key] {
+			tags[*tag.Key] = *tag.Value
+		}
+	}
+	return tags
+}
+
+// checkEncryption refuses existing unencrypted volumes if encryption is
+// requested.
+func checkEncryption(asgEbs AsgEbs, cfg Config, volumeId string) error {
+	if !volumeOptions(cfg).Encrypted {
+		return nil
+	}
+	volume, err := asgEbs.describeVolume(volumeId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to describe volume")
+		return err
+	}
+	if volume.Encrypted == nil || !*volume.Encrypted {
+		err = fmt.Errorf("volume %s is not encrypted", volumeId)
+		log.WithFields(log.Fields{"volume": volumeId}).Error("Refusing to attach unencrypted volume, migrate it to an encrypted one via snapshot")
+		return err
+	}
+	return nil
+}
+
+// encryptedSnapshot returns the given snapshot if it is encrypted, otherwise
+// an encrypted copy of it. The copy is only needed to create the volume and
+// deleted once the volume is available.
+func encryptedSnapshot(asgEbs AsgEbs, cfg Config, snapshotId string) (*string, error) {
+	snapshot, err := asgEbs.describeSnapshot(snapshotId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "snapshot": snapshotId}).Error("Failed to describe snapshot")
+		return nil, err
+	}
+	if snapshot.Encrypted != nil && *snapshot.Encrypted {
+		return &snapshotId, nil
+	}
+
+	log.WithFields(log.Fields{"snapshot": snapshotId}).Info("Copying unencrypted snapshot to an encrypted one")
+	copyId, err := asgEbs.copySnapshot(snapshotId, volumeOptions(cfg))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "snapshot": snapshotId}).Error("Failed to copy snapshot")
+		return nil, err
+	}
+	log.WithFields(log.Fields{"snapshot": *copyId}).Info("Waiting until snapshot is completed")
+	err = asgEbs.waitUntilSnapshotCompleted(*copyId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "snapshot": *copyId}).Error("Waiting for snapshot timed out")
+		return nil, err
+	}
+	return copyId, nil
+}
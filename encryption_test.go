@@ -0,0 +1,151 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newEncryptedConfig() *Config {
+	cfg := newConfig()
+	cfg.kmsKeyId = strPtr("alias/data")
+	return cfg
+}
+
+var encryptedOptions = VolumeOptions{Encrypted: true, KmsKeyId: "alias/data"}
+
+func TestCreateEncryptedVolume(t *testing.T) {
+	cfg := newEncryptedConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil), encryptedOptions)
+}
+
+func TestCopyUnencryptedSnapshot(t *testing.T) {
+	cfg := newEncryptedConfig()
+	cfg.snapshotName = strPtr("my-name")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	encryptedSnapshotId := "snap-654321"
+
+	fakeAsgEbs.
+		On("findSnapshot", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultSnapshotId, nil)
+	fakeAsgEbs.
+		On("describeSnapshot", defaultSnapshotId).
+		Return(&ec2.Snapshot{SnapshotId: aws.String(defaultSnapshotId), Encrypted: aws.Bool(false)}, nil)
+	fakeAsgEbs.
+		On("copySnapshot", defaultSnapshotId, encryptedOptions).
+		Return(encryptedSnapshotId, nil)
+	fakeAsgEbs.
+		On("waitUntilSnapshotCompleted", encryptedSnapshotId).
+		Return(nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("deleteSnapshot", encryptedSnapshotId).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{}, nil)
+	fakeAsgEbs.
+		On("detectFileSystem", "/dev/xvdc").
+		Return("ext4", nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+	fakeAsgEbs.
+		On("fileSystemSize", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(int64(200<<30), nil)
+	fakeAsgEbs.
+		On("deviceSize", mock.AnythingOfType("string")).
+		Return(int64(200<<30), nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "copySnapshot", defaultSnapshotId, encryptedOptions)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, strPtr(encryptedSnapshotId), encryptedOptions)
+	fakeAsgEbs.AssertCalled(t, "deleteSnapshot", encryptedSnapshotId)
+	fakeAsgEbs.AssertNotCalled(t, "deleteSnapshot", defaultSnapshotId)
+}
+
+func TestRefuseUnencryptedVolume(t *testing.T) {
+	cfg := newEncryptedConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("describeVolume", defaultVolumeId).
+		Return(&ec2.Volume{VolumeId: aws.String(defaultVolumeId), Encrypted: aws.Bool(false)}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 0)
+}
+
+func TestCopyTagsMarkCopyTransient(t *testing.T) {
+	tags := copyTags([]*ec2.Tag{
+		{Key: aws.String("Name"), Value: aws.String("my-snapshot")},
+		{Key: aws.String("my-key"), Value: aws.String("my-value")},
+		{Key: aws.String(fileSystemTypeTag), Value: aws.String("xfs")},
+		{Key: aws.String(fileSystemUuidTag), Value: aws.String("0123-4567")},
+	})
+
+	assert.Equal(t, map[string]string{
+		transientTag:      "true",
+		fileSystemTypeTag: "xfs",
+		fileSystemUuidTag: "0123-4567",
+	}, tags)
+}
+
+func TestRestorableSnapshotsSkipTransientCopies(t *testing.T) {
+	snapshots := restorableSnapshots([]*ec2.Snapshot{
+		{SnapshotId: aws.String("snap-1")},
+		{SnapshotId: aws.String("snap-2"), Tags: []*ec2.Tag{{Key: aws.String(transientTag), Value: aws.String("true")}}},
+	})
+
+	assert.Len(t, snapshots, 1)
+	assert.Equal(t, "snap-1", *snapshots[0].SnapshotId)
+}
@@ -0,0 +1,252 @@
+package main
+
+import (
+	"crypto/rand"
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	fileSystemTypeTag = "filesystem-type"
+	fileSystemUuidTag = "filesystem-uuid"
+)
+
+// FileSystem describes how to create, measure and grow a file system of a
+// given type. UuidFlag and UuidValue, formatted with the UUID, set the UUID
+// of new file systems. Size and Grow are run with the device appended, or the
+// mount point if Mounted is set. ParseSize reads the size in bytes from the
+// output of Size.
+type FileSystem struct {
+	Mkfs           string
+	LabelFlag      string
+	InodeRatioFlag string
+	UuidFlag       string
+	UuidValue      string
+	Size           []string
+	ParseSize      func(out string) (int64, error)
+	Grow           []string
+	Mounted        bool
+}
+
+var fileSystems = map[string]FileSystem{
+	"ext4": {
+		Mkfs:           "/usr/sbin/mkfs.ext4",
+		LabelFlag:      "-L",
+		InodeRatioFlag: "-i",
+		UuidFlag:       "-U",
+		UuidValue:      "%s",
+		Size:           []string{"/sbin/dumpe2fs", "-h"},
+		ParseSize:      parseDumpe2fsSize,
+		Grow:           []string{"/sbin/resize2fs"},
+	},
+	"xfs": {
+		Mkfs:      "/sbin/mkfs.xfs",
+		LabelFlag: "-L",
+		UuidFlag:  "-m",
+		UuidValue: "uuid=%s",
+		Size:      []string{"/usr/sbin/xfs_info"},
+		ParseSize: parseXfsInfoSize,
+		Grow:      []string{"/usr/sbin/xfs_growfs"},
+		Mounted:   true,
+	},
+	"btrfs": {
+		Mkfs:      "/sbin/mkfs.btrfs",
+		LabelFlag: "-L",
+		UuidFlag:  "-U",
+		UuidValue: "%s",
+		Size:      []string{"/sbin/btrfs", "filesystem", "show", "--raw"},
+		ParseSize: parseBtrfsShowSize,
+		Grow:      []string{"/sbin/btrfs", "filesystem", "resize", "max"},
+		Mounted:   true,
+	},
+}
+
+func fileSystemNames() []string {
+	names := []string{}
+	for name := range fileSystems {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// mkfsArgs returns the mkfs arguments for the configured file system, without
+// the device.
+func mkfsArgs(cfg Config) []string {
+	fileSystem := fileSystems[*cfg.fileSystem]
+
+	args := []string{}
+	if fileSystem.InodeRatioFlag != "" {
+		args = append(args, fileSystem.InodeRatioFlag, fmt.Sprintf("%d", *cfg.mkfsInodeRatio))
+	}
+	if *cfg.fileSystemLabel != "" {
+		args = append(args, fileSystem.LabelFlag, *cfg.fileSystemLabel)
+	}
+	return append(args, strings.Fields(*cfg.mkfsOptions)...)
+}
+
+// newFileSystemUuid returns a random version 4 UUID.
+func newFileSystemUuid() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	b[6] = b[6]&0x0f | 0x40
+	b[8] = b[8]&0x3f | 0x80
+	return fmt.Sprintf("%x-%x-%x-%x-%x", b[0:4], b[4:6], b[6:8], b[8:10], b[10:16]), nil
+}
+
+// uuidArgs returns the mkfs arguments to create a file system with the UUID.
+func uuidArgs(fileSystem string, uuid string) []string {
+	fs := fileSystems[fileSystem]
+	return []string{fs.UuidFlag, fmt.Sprintf(fs.UuidValue, uuid)}
+}
+
+func (awsAsgEbs *AwsAsgEbs) fileSystemUuid(device string) (string, error) {
+	out, err := output("/sbin/blkid", "-o", "value", "-s", "UUID", device)
+	if err != nil {
+		return "", err
+	}
+	uuid := strings.TrimSpace(out)
+	if uuid == "" {
+		return "", fmt.Errorf("no file system UUID found on %s", device)
+	}
+	return uuid, nil
+}
+
+// verifyFileSystemUuid makes sure the device holds the file system created on
+// the volume, by comparing its UUID with the one recorded on the volume. A
+// leftover or renamed device must never be mounted in place of the volume.
+// Volumes without a recorded UUID, e.g. those created by older versions,
+// cannot be verified.
+func verifyFileSystemUuid(asgEbs AsgEbs, volumeId string, device string) error {
+	tags, err := asgEbs.volumeTags(volumeId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to read tags of volume")
+		return err
+	}
+	expected := tags[fileSystemUuidTag]
+	if expected == "" {
+		log.WithFields(log.Fields{"volume": volumeId, "device": device}).Info("No file system UUID recorded on volume, not verifying device")
+		return nil
+	}
+	uuid, err := asgEbs.fileSystemUuid(device)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "device": device}).Error("Failed to read file system UUID")
+		return err
+	}
+	if !strings.EqualFold(uuid, expected) {
+		log.WithFields(log.Fields{"volume": volumeId, "device": device, "uuid": uuid, "expected_uuid": expected}).Error("File system UUID on device does not match volume, refusing to mount")
+		return fmt.Errorf("file system on %s has UUID %s, but volume %s has %s", device, uuid, volumeId, expected)
+	}
+	return nil
+}
+
+// volumeFileSystem returns the file system type recorded on the volume. If
+// it is unknown, e.g. for volumes restored from a snapshot, it is detected on
+// the device.
+func volumeFileSystem(asgEbs AsgEbs, volumeId string, device string) (string, error) {
+	tags, err := asgEbs.volumeTags(volumeId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to read tags of volume")
+		return "", err
+	}
+	if fileSystem := tags[fileSystemTypeTag]; fileSystem != "" {
+		return fileSystem, nil
+	}
+	fileSystem, err := asgEbs.detectFileSystem(device)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "device": device}).Error("Failed to detect file system")
+		return "", err
+	}
+	return fileSystem, nil
+}
+
+// parseDumpe2fsSize reads the size of an ext4 file system from the output of
+// dumpe2fs -h.
+func parseDumpe2fsSize(out string) (int64, error) {
+	var blockCount, blockSize int64
+	for _, line := range strings.Split(out, "\n") {
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		value, err := strconv.ParseInt(strings.TrimSpace(parts[1]), 10, 64)
+		switch parts[0] {
+		case "Block count":
+			if err != nil {
+				return 0, err
+			}
+			blockCount = value
+		case "Block size":
+			if err != nil {
+				return 0, err
+			}
+			blockSize = value
+		}
+	}
+	if blockCount == 0 || blockSize == 0 {
+		return 0, fmt.Errorf("no block count and size in dumpe2fs output")
+	}
+	return blockCount * blockSize, nil
+}
+
+// parseXfsInfoSize reads the size of the data section of an xfs file system
+// from the output of xfs_info.
+func parseXfsInfoSize(out string) (int64, error) {
+	for _, line := range strings.Split(out, "\n") {
+		if !strings.HasPrefix(line, "data") {
+			continue
+		}
+		var blocks, blockSize int64
+		for _, field := range strings.Fields(strings.Replace(line, ",", " ", -1)) {
+			parts := strings.SplitN(field, "=", 2)
+			if len(parts) != 2 {
+				continue
+			}
+			value, err := strconv.ParseInt(parts[1], 10, 64)
+			switch parts[0] {
+			case "blocks":
+				if err != nil {
+					return 0, err
+				}
+				blocks = value
+			case "bsize":
+				if err != nil {
+					return 0, err
+				}
+				blockSize = value
+			}
+		}
+		if blocks > 0 && blockSize > 0 {
+			return blocks * blockSize, nil
+		}
+	}
+	return 0, fmt.Errorf("no data section in xfs_info output")
+}
+
+// parseBtrfsShowSize reads the size of a btrfs file system from the output of
+// btrfs filesystem show --raw, adding up the sizes of all its devices.
+func parseBtrfsShowSize(out string) (int64, error) {
+	var size int64
+	for _, line := range strings.Split(out, "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 4 || fields[0] != "devid" || fields[2] != "size" {
+			continue
+		}
+		value, err := strconv.ParseInt(fields[3], 10, 64)
+		if err != nil {
+			return 0, err
+		}
+		size += value
+	}
+	if size == 0 {
+		return 0, fmt.Errorf("no devices in btrfs filesystem show output")
+	}
+	return size, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMkfsArgs(t *testing.T) {
+	cfg := newConfig()
+	assert.Equal(t, []string{"-i", "4096"}, mkfsArgs(*cfg))
+
+	cfg.fileSystemLabel = strPtr("data")
+	cfg.mkfsOptions = strPtr("-m 1  -E lazy_itable_init=0")
+	assert.Equal(t, []string{"-i", "4096", "-L", "data", "-m", "1", "-E", "lazy_itable_init=0"}, mkfsArgs(*cfg))
+
+	cfg.fileSystem = strPtr("xfs")
+	cfg.mkfsOptions = strPtr("-m crc=1")
+	assert.Equal(t, []string{"-L", "data", "-m", "crc=1"}, mkfsArgs(*cfg))
+}
+
+func TestCreateXfsFileSystem(t *testing.T) {
+	cfg := newConfig()
+	cfg.fileSystem = strPtr("xfs")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", "/dev/xvdc", "xfs", []string{}, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "")
+}
+
+func TestParseFileSystemSizes(t *testing.T) {
+	size, err := parseDumpe2fsSize(`Filesystem volume name:   data
+Block count:              13107200
+Reserved block count:     655360
+Block size:               4096
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(53687091200), size)
+
+	size, err = parseXfsInfoSize(`meta-data=/dev/xvdc              isize=512    agcount=4, agsize=3276800 blks
+         =                       sectsz=512   attr=2, projid32bit=1
+data     =                       bsize=4096   blocks=13107200, imaxpct=25
+         =                       sunit=0      swidth=0 blks
+log      =internal log           bsize=4096   blocks=6400, version=2
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(53687091200), size)
+
+	size, err = parseBtrfsShowSize(`Label: none  uuid: 3a5e2f6c-3c1b-4b6e-9a5f-0b6a4d3c2e1f
+	Total devices 1 FS bytes used 196608
+	devid    1 size 53687091200 used 2172649472 path /dev/xvdc
+`)
+	assert.NoError(t, err)
+	assert.Equal(t, int64(53687091200), size)
+
+	_, err = parseDumpe2fsSize("dumpe2fs 1.45.5 (07-Jan-2020)\n")
+	assert.Error(t, err)
+}
+
+func TestUuidArgs(t *testing.T) {
+	uuid, err := newFileSystemUuid()
+	assert.NoError(t, err)
+	assert.Regexp(t, "^[0-9a-f]{8}-[0-9a-f]{4}-4[0-9a-f]{3}-[89ab][0-9a-f]{3}-[0-9a-f]{12}$", uuid)
+
+	assert.Equal(t, []string{"-U", uuid}, uuidArgs("ext4", uuid))
+	assert.Equal(t, []string{"-m", "uuid=" + uuid}, uuidArgs("xfs", uuid))
+	assert.Equal(t, []string{"-U", uuid}, uuidArgs("btrfs", uuid))
+}
+
+func TestMountVolumeWithMatchingUuid(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := newReattachFakeWithTags(200, map[string]string{fileSystemTypeTag: "xfs", fileSystemUuidTag: "3a5e2f6c-3c1b-4b6e-9a5f-0b6a4d3c2e1f"})
+
+	fakeAsgEbs.
+		On("fileSystemUuid", "/dev/xvdc").
+		Return("3A5E2F6C-3C1B-4B6E-9A5F-0B6A4D3C2E1F", nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "")
+}
+
+func TestRefuseToMountVolumeWithOtherUuid(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := newReattachFakeWithTags(200, map[string]string{fileSystemTypeTag: "xfs", fileSystemUuidTag: "3a5e2f6c-3c1b-4b6e-9a5f-0b6a4d3c2e1f"})
+
+	fakeAsgEbs.
+		On("fileSystemUuid", "/dev/xvdc").
+		Return("0b6a4d3c-2e1f-4b6e-9a5f-3a5e2f6c3c1b", nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "")
+}
+
+func TestMountVolumeWithoutRecordedUuid(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := newReattachFake(200)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "fileSystemUuid", "/dev/xvdc")
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "")
+}
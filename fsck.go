@@ -0,0 +1,192 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"syscall"
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Policies for checking file systems of existing volumes before mounting.
+const (
+	fsckSkip   = "skip"
+	fsckCheck  = "check"
+	fsckRepair = "repair"
+)
+
+var fsckPolicies = []string{fsckSkip, fsckCheck, fsckRepair}
+
+// Outcomes of a file system check, recorded in the fsck tag.
+const (
+	fsckClean    = "clean"
+	fsckRepaired = "repaired"
+	fsckErrors   = "errors"
+)
+
+const (
+	fsckTag     = "fsck"
+	fsckTimeTag = "fsck-time"
+)
+
+// FsckCommand is how to check or repair a file system. Outcomes maps exit
+// codes to outcomes, any other exit code is an error. DirtyLog is the exit
+// code telling that the log has to be replayed by mounting the file system
+// before it can be repaired, if not 0.
+type FsckCommand struct {
+	Args     []string
+	Outcomes map[int]string
+	DirtyLog int
+}
+
+var fsckCommands = map[string]map[string]FsckCommand{
+	"ext4": {
+		fsckCheck: {
+			Args:     []string{"/sbin/e2fsck", "-n"},
+			Outcomes: map[int]string{0: fsckClean, 4: fsckErrors},
+		},
+		fsckRepair: {
+			Args:     []string{"/sbin/e2fsck", "-p"},
+			Outcomes: map[int]string{0: fsckClean, 1: fsckRepaired, 2: fsckRepaired, 4: fsckErrors},
+		},
+	},
+	"xfs": {
+		fsckCheck: {
+			Args:     []string{"/sbin/xfs_repair", "-n"},
+			Outcomes: map[int]string{0: fsckClean, 1: fsckErrors},
+		},
+		fsckRepair: {
+			Args:     []string{"/sbin/xfs_repair"},
+			Outcomes: map[int]string{0: fsckClean, 1: fsckErrors},
+			DirtyLog: 2,
+		},
+	},
+	// btrfs check --repair is not considered safe, btrfs repairs itself
+	// when mounted.
+	"btrfs": {
+		fsckCheck: {
+			Args:     []string{"/sbin/btrfs", "check", "--readonly"},
+			Outcomes: map[int]string{0: fsckClean, 1: fsckErrors},
+		},
+	},
+}
+
+// exitCode runs the command and returns its exit code. Commands which cannot
+// be run or are killed return an error.
+func exitCode(cmd string, args ...string) (int, error) {
+	log.WithFields(log.Fields{"cmd": cmd, "args": args}).Info("Running command")
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	if exitErr, ok := err.(*exec.ExitError); ok {
+		if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.Exited() {
+			log.WithFields(log.Fields{"cmd": cmd, "args": args, "exit_code": status.ExitStatus(), "out": string(out)}).Info("Command failed")
+			return status.ExitStatus(), nil
+		}
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": cmd, "args": args, "err": err, "out": string(out)}).Info("Error running command")
+		return 0, err
+	}
+	return 0, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) checkFileSystem(device string, fileSystem string, policy string) (string, error) {
+	commands, ok := fsckCommands[fileSystem]
+	if !ok {
+		return "", fmt.Errorf("cannot check file system type %q", fileSystem)
+	}
+	command, ok := commands[policy]
+	if !ok {
+		log.WithFields(log.Fields{"filesystem": fileSystem, "policy": policy}).Warn("File system cannot be repaired offline, only checking it")
+		command = commands[fsckCheck]
+	}
+	return runFsckCommand(command, device, func() error {
+		return replayLog(device, fileSystem)
+	})
+}
+
+// replayLog mounts and unmounts the file system, which replays its log.
+func replayLog(device string, fileSystem string) error {
+	dir, err := ioutil.TempDir("", "asg-ebs-replay")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(dir)
+	err = run("/bin/mount", "-t", fileSystem, device, dir)
+	if err != nil {
+		return err
+	}
+	return run("/bin/umount", dir)
+}
+
+// runFsckCommand runs the command on the device and returns the outcome. A
+// dirty log is replayed once before running the command again.
+func runFsckCommand(command FsckCommand, device string, replayLog func() error) (string, error) {
+	code, err := exitCode(command.Args[0], append(command.Args[1:], device)...)
+	if err != nil {
+		return "", err
+	}
+	if command.DirtyLog != 0 && code == command.DirtyLog {
+		log.WithFields(log.Fields{"device": device}).Info("Replaying dirty file system log")
+		err = replayLog()
+		if err != nil {
+			return "", err
+		}
+		code, err = exitCode(command.Args[0], append(command.Args[1:], device)...)
+		if err != nil {
+			return "", err
+		}
+	}
+	outcome, ok := command.Outcomes[code]
+	if !ok {
+		return "", fmt.Errorf("%s failed with exit code %d", command.Args[0], code)
+	}
+	return outcome, nil
+}
+
+// checkVolumeFileSystem checks the file system of an existing volume before
+// mounting it according to the fsck policy and records the outcome on the
+// volumes. File systems are still mounted if they are only checked, but not
+// if repairing them failed.
+func checkVolumeFileSystem(asgEbs AsgEbs, cfg Config, device string, fileSystem string, volumeIds []string) error {
+	policy := *cfg.fsck
+	if policy == fsckSkip {
+		return nil
+	}
+
+	log.WithFields(log.Fields{"device": device, "filesystem": fileSystem, "policy": policy}).Info("Checking file system")
+	outcome, err := asgEbs.checkFileSystem(device, fileSystem, policy)
+	if err != nil && policy == fsckCheck {
+		log.WithFields(log.Fields{"error": err, "device": device}).Warn("Failed to check file system, mounting it anyway")
+		return nil
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "device": device}).Error("Failed to repair file system")
+		return err
+	}
+
+	fields := log.Fields{"device": device, "filesystem": fileSystem, "outcome": outcome}
+	switch {
+	case outcome != fsckErrors:
+		log.WithFields(fields).Info("File system check finished")
+	case policy == fsckCheck:
+		log.WithFields(fields).Warn("File system has errors, mounting it anyway")
+	default:
+		log.WithFields(fields).Error("File system has errors which could not be repaired")
+	}
+
+	tags := map[string]string{fsckTag: outcome, fsckTimeTag: time.Now().UTC().Format(time.RFC3339)}
+	for _, volumeId := range volumeIds {
+		err = asgEbs.tagVolume(volumeId, tags)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": volumeId}).Warn("Failed to tag volume with file system check outcome")
+		}
+	}
+
+	if outcome == fsckErrors && policy == fsckRepair {
+		return fmt.Errorf("file system on %s has errors", device)
+	}
+	return nil
+}
@@ -0,0 +1,158 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestExitCode(t *testing.T) {
+	code, err := exitCode("/bin/sh", "-c", "exit 4")
+	assert.NoError(t, err)
+	assert.Equal(t, 4, code)
+
+	code, err = exitCode("/bin/true")
+	assert.NoError(t, err)
+	assert.Equal(t, 0, code)
+
+	_, err = exitCode("/nonexistent/e2fsck")
+	assert.Error(t, err)
+}
+
+func TestReplayDirtyLogBeforeRepairing(t *testing.T) {
+	dir, err := ioutil.TempDir("", "fsck")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	replayed := filepath.Join(dir, "replayed")
+	command := FsckCommand{
+		Args:     []string{"/bin/sh", "-c", `test -e "$0" || exit 2`, replayed},
+		Outcomes: map[int]string{0: fsckClean, 1: fsckErrors},
+		DirtyLog: 2,
+	}
+
+	outcome, err := runFsckCommand(command, "/dev/xvdc", func() error {
+		return ioutil.WriteFile(replayed, nil, 0644)
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, fsckClean, outcome)
+}
+
+func TestFailOnDirtyLogAfterReplay(t *testing.T) {
+	command := FsckCommand{
+		Args:     []string{"/bin/sh", "-c", "exit 2"},
+		Outcomes: map[int]string{0: fsckClean, 1: fsckErrors},
+		DirtyLog: 2,
+	}
+	replays := 0
+
+	_, err := runFsckCommand(command, "/dev/xvdc", func() error {
+		replays++
+		return nil
+	})
+
+	assert.Error(t, err)
+	assert.Equal(t, 1, replays)
+}
+
+func TestSkipFsckByDefault(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := newReattachFake(200)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "checkFileSystem", 0)
+}
+
+func TestRepairReattachedFileSystem(t *testing.T) {
+	cfg := newConfig()
+	cfg.fsck = strPtr(fsckRepair)
+	fakeAsgEbs := newReattachFake(200)
+
+	fakeAsgEbs.
+		On("checkFileSystem", "/dev/xvdc", "xfs", fsckRepair).
+		Return(fsckRepaired, nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, mock.MatchedBy(func(tags map[string]string) bool { return tags[fsckTag] == fsckRepaired })).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "checkFileSystem", "/dev/xvdc", "xfs", fsckRepair)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "")
+}
+
+func TestMountCheckedFileSystemWithErrors(t *testing.T) {
+	cfg := newConfig()
+	cfg.fsck = strPtr(fsckCheck)
+	fakeAsgEbs := newReattachFake(200)
+
+	fakeAsgEbs.
+		On("checkFileSystem", "/dev/xvdc", "xfs", fsckCheck).
+		Return(fsckErrors, nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, mock.MatchedBy(func(tags map[string]string) bool { return tags[fsckTag] == fsckErrors })).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "")
+}
+
+func TestRefuseUnrepairedFileSystem(t *testing.T) {
+	cfg := newConfig()
+	cfg.fsck = strPtr(fsckRepair)
+	fakeAsgEbs := newReattachFake(200)
+
+	fakeAsgEbs.
+		On("checkFileSystem", "/dev/xvdc", "xfs", fsckRepair).
+		Return(fsckErrors, nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, mock.MatchedBy(func(tags map[string]string) bool { return tags[fsckTag] == fsckErrors })).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "mountVolume", 0)
+}
+
+func TestMountFileSystemWhenCheckFails(t *testing.T) {
+	cfg := newConfig()
+	cfg.fsck = strPtr(fsckCheck)
+	fakeAsgEbs := newReattachFake(200)
+
+	fakeAsgEbs.
+		On("checkFileSystem", "/dev/xvdc", "xfs", fsckCheck).
+		Return("", errors.New("xfs_repair failed with exit code 2"))
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "")
+}
+
+func TestRefuseFileSystemWhenRepairFails(t *testing.T) {
+	cfg := newConfig()
+	cfg.fsck = strPtr(fsckRepair)
+	fakeAsgEbs := newReattachFake(200)
+
+	fakeAsgEbs.
+		On("checkFileSystem", "/dev/xvdc", "xfs", fsckRepair).
+		Return("", errors.New("xfs_repair failed with exit code 2"))
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "mountVolume", 0)
+}
@@ -0,0 +1,195 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// luksTag marks volumes holding a LUKS container instead of a file system.
+const luksTag = "luks"
+
+func runWithInput(input []byte, cmd string, args ...string) error {
+	log.WithFields(log.Fields{"cmd": cmd, "args": args}).Info("Running command")
+	command := exec.Command(cmd, args...)
+	command.Stdin = bytes.NewReader(input)
+	out, err := command.CombinedOutput()
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": cmd, "args": args, "err": err, "out": string(out)}).Info("Error running command")
+		return err
+	}
+	return nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) luksFormat(device string, key []byte) error {
+	return runWithInput(key, "/sbin/cryptsetup", "luksFormat", "--batch-mode", "--key-file", "-", device)
+}
+
+func (awsAsgEbs *AwsAsgEbs) luksOpen(device string, name string, key []byte) error {
+	return runWithInput(key, "/sbin/cryptsetup", "open", "--type", "luks", "--key-file", "-", device, name)
+}
+
+func (awsAsgEbs *AwsAsgEbs) luksResize(name string, key []byte) error {
+	return runWithInput(key, "/sbin/cryptsetup", "resize", "--key-file", "-", name)
+}
+
+func (awsAsgEbs *AwsAsgEbs) isLuks(device string) (bool, error) {
+	code, err := exitCode("/sbin/cryptsetup", "isLuks", device)
+	if err != nil {
+		return false, err
+	}
+	switch code {
+	case 0:
+		return true, nil
+	case 1:
+		return false, nil
+	}
+	return false, fmt.Errorf("cryptsetup isLuks exited with %d", code)
+}
+
+var crypttabFile = "/etc/crypttab"
+
+func crypttabEntry(name string, uuid string, keyFile string) string {
+	return fmt.Sprintf("%s UUID=%s %s luks,nofail", name, uuid, escapeFstabField(keyFile))
+}
+
+// persistLuks adds the LUKS container to crypttab, so it is opened on boot
+// before the file system in it is mounted.
+func (awsAsgEbs *AwsAsgEbs) persistLuks(device string, name string, keyFile string) error {
+	uuid, err := awsAsgEbs.fileSystemUuid(device)
+	if err != nil {
+		return err
+	}
+	crypttab, err := ioutil.ReadFile(crypttabFile)
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return writeFileAtomically(crypttabFile, updateTable(string(crypttab), 0, name, crypttabEntry(name, uuid, keyFile)))
+}
+
+func validateLuks(cfg Config) error {
+	hasKey := *cfg.luksKeyFile != "" || *cfg.luksKeyCommand != ""
+	if *cfg.luksName == "" {
+		if hasKey {
+			return errors.New("--luks-key-file and --luks-key-command need --luks-name")
+		}
+		return nil
+	}
+	if !hasKey {
+		return errors.New("--luks-name needs --luks-key-file or --luks-key-command")
+	}
+	if *cfg.luksKeyFile != "" && *cfg.luksKeyCommand != "" {
+		return errors.New("--luks-key-file and --luks-key-command are mutually exclusive")
+	}
+	if *cfg.luksKeyCommand != "" && *cfg.persistMount != persistNone {
+		return errors.New("--persist-mount needs --luks-key-file, as crypttab cannot run --luks-key-command on boot")
+	}
+	return nil
+}
+
+// luksKey reads the key from the key file or the output of the key command.
+func luksKey(cfg Config) ([]byte, error) {
+	if *cfg.luksKeyFile != "" {
+		return ioutil.ReadFile(*cfg.luksKeyFile)
+	}
+	return exec.Command("/bin/sh", "-c", *cfg.luksKeyCommand).Output()
+}
+
+// setupLuks formats new volumes as LUKS containers and opens them. It
+// returns the device of the opened mapping. Reattached volumes are LUKS
+// containers if they carry the LUKS tag or cryptsetup detects one, e.g. on
+// volumes restored from untagged snapshots. LUKS volumes are never used
+// without opening them. Persisted mounts get a crypttab entry.
+func setupLuks(asgEbs AsgEbs, cfg Config, device string, volumeIds []string, create bool) (string, error) {
+	name := *cfg.luksName
+
+	if !create {
+		tags, err := asgEbs.volumeTags(volumeIds[0])
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": volumeIds[0]}).Error("Failed to read tags of volume")
+			return "", err
+		}
+		isLuks := tags[luksTag] == "true"
+		if !isLuks {
+			isLuks, err = asgEbs.isLuks(device)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "device": device}).Error("Failed to detect LUKS container")
+				return "", err
+			}
+		}
+		if name == "" && isLuks {
+			log.WithFields(log.Fields{"volume": volumeIds[0]}).Error("Volume is LUKS encrypted, but no --luks-name is given")
+			return "", errors.New("volume " + volumeIds[0] + " is LUKS encrypted")
+		}
+		if name != "" && !isLuks {
+			log.WithFields(log.Fields{"volume": volumeIds[0]}).Error("Volume is not LUKS encrypted")
+			return "", errors.New("volume " + volumeIds[0] + " is not LUKS encrypted")
+		}
+	}
+	if name == "" {
+		return device, nil
+	}
+
+	key, err := luksKey(cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to get LUKS key")
+		return "", err
+	}
+
+	if create {
+		log.WithFields(log.Fields{"device": device}).Info("Formatting LUKS container")
+		err = asgEbs.luksFormat(device, key)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "device": device}).Error("Failed to format LUKS container")
+			return "", err
+		}
+		for _, volumeId := range volumeIds {
+			err = asgEbs.tagVolume(volumeId, map[string]string{luksTag: "true"})
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to tag volume")
+				return "", err
+			}
+		}
+	}
+
+	if asgEbs.checkDevice("/dev/mapper/"+name) != nil {
+		log.WithFields(log.Fields{"device": device, "name": name}).Info("LUKS container is already open")
+	} else {
+		log.WithFields(log.Fields{"device": device, "name": name}).Info("Opening LUKS container")
+		err = asgEbs.luksOpen(device, name, key)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "device": device}).Error("Failed to open LUKS container")
+			return "", err
+		}
+	}
+
+	if *cfg.persistMount != persistNone {
+		log.WithFields(log.Fields{"device": device, "name": name}).Info("Persisting LUKS container")
+		err = asgEbs.persistLuks(device, name, *cfg.luksKeyFile)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "device": device}).Error("Failed to persist LUKS container")
+			return "", err
+		}
+	}
+	return "/dev/mapper/" + name, nil
+}
+
+// resizeLuks makes the opened LUKS container fill its grown device.
+func resizeLuks(asgEbs AsgEbs, cfg Config) error {
+	key, err := luksKey(cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to get LUKS key")
+		return err
+	}
+	log.WithFields(log.Fields{"name": *cfg.luksName}).Info("Resizing LUKS container")
+	err = asgEbs.luksResize(*cfg.luksName, key)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "name": *cfg.luksName}).Error("Failed to resize LUKS container")
+	}
+	return err
+}
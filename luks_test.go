@@ -0,0 +1,216 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newLuksConfig(t *testing.T) (*Config, func()) {
+	keyFile, err := ioutil.TempFile("", "luks-key")
+	if err != nil {
+		t.Fatal(err)
+	}
+	keyFile.WriteString("secret")
+	keyFile.Close()
+
+	cfg := newConfig()
+	cfg.luksName = strPtr("data")
+	cfg.luksKeyFile = strPtr(keyFile.Name())
+	return cfg, func() { os.Remove(keyFile.Name()) }
+}
+
+func TestValidateLuks(t *testing.T) {
+	cfg := newConfig()
+	assert.NoError(t, validateLuks(*cfg))
+
+	cfg.luksKeyFile = strPtr("/etc/luks.key")
+	assert.Error(t, validateLuks(*cfg))
+
+	cfg.luksName = strPtr("data")
+	assert.NoError(t, validateLuks(*cfg))
+
+	cfg.luksKeyCommand = strPtr("vault read -field=key secret/luks")
+	assert.Error(t, validateLuks(*cfg))
+
+	cfg.luksKeyFile = strPtr("")
+	assert.NoError(t, validateLuks(*cfg))
+
+	cfg.persistMount = strPtr(persistFstab)
+	assert.Error(t, validateLuks(*cfg))
+
+	cfg.luksKeyCommand = strPtr("")
+	assert.Error(t, validateLuks(*cfg))
+}
+
+func TestCrypttabEntry(t *testing.T) {
+	crypttab := updateTable("# <name> <device> <key> <options>\ndata UUID=old /etc/old.key luks\n", 0, "data", crypttabEntry("data", "0123-4567", "/etc/luks key"))
+
+	assert.Equal(t, "# <name> <device> <key> <options>\ndata UUID=0123-4567 /etc/luks\\040key luks,nofail\n", crypttab)
+}
+
+func TestLuksKeyCommand(t *testing.T) {
+	cfg := newConfig()
+	cfg.luksKeyCommand = strPtr("printf secret")
+
+	key, err := luksKey(*cfg)
+
+	assert.NoError(t, err)
+	assert.Equal(t, []byte("secret"), key)
+}
+
+func TestFormatNewVolumeWithLuks(t *testing.T) {
+	cfg, cleanup := newLuksConfig(t)
+	defer cleanup()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("luksFormat", "/dev/xvdc", []byte("secret")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, mock.AnythingOfType("map[string]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("luksOpen", "/dev/xvdc", "data", []byte("secret")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "tagVolume", defaultVolumeId, map[string]string{luksTag: "true"})
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", "/dev/mapper/data", *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/mapper/data", *cfg.mountPoint, *cfg.fileSystem, "")
+}
+
+func TestOpenReattachedLuksVolume(t *testing.T) {
+	cfg, cleanup := newLuksConfig(t)
+	defer cleanup()
+	fakeAsgEbs := newReattachFakeWithTags(200, map[string]string{fileSystemTypeTag: "ext4", luksTag: "true"})
+
+	fakeAsgEbs.
+		On("luksOpen", "/dev/xvdc", "data", []byte("secret")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "luksFormat", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "makeFileSystem", 0)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/mapper/data", *cfg.mountPoint, "ext4", "")
+}
+
+func TestOpenUntaggedLuksVolume(t *testing.T) {
+	cfg, cleanup := newLuksConfig(t)
+	defer cleanup()
+	fakeAsgEbs := newReattachFakeWithTags(200, map[string]string{fileSystemTypeTag: "ext4"})
+	fakeAsgEbs.LuksDevices = map[string]bool{"/dev/xvdc": true}
+
+	fakeAsgEbs.
+		On("luksOpen", "/dev/xvdc", "data", []byte("secret")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/mapper/data", *cfg.mountPoint, "ext4", "")
+}
+
+func TestPersistLuksContainer(t *testing.T) {
+	cfg, cleanup := newLuksConfig(t)
+	defer cleanup()
+	cfg.persistMount = strPtr(persistSystemd)
+	fakeAsgEbs := newReattachFakeWithTags(200, map[string]string{fileSystemTypeTag: "ext4", luksTag: "true"})
+
+	fakeAsgEbs.
+		On("luksOpen", "/dev/xvdc", "data", []byte("secret")).
+		Return(nil)
+	fakeAsgEbs.
+		On("persistLuks", "/dev/xvdc", "data", *cfg.luksKeyFile).
+		Return(nil)
+	fakeAsgEbs.
+		On("persistMount", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "persistLuks", "/dev/xvdc", "data", *cfg.luksKeyFile)
+	fakeAsgEbs.AssertCalled(t, "persistMount", "/dev/mapper/data", *cfg.mountPoint, "ext4", "", persistSystemd)
+}
+
+func TestResizeLuksContainerOfGrownVolume(t *testing.T) {
+	cfg, cleanup := newLuksConfig(t)
+	defer cleanup()
+	fakeAsgEbs := newReattachFakeWithTags(100, map[string]string{fileSystemTypeTag: "ext4", luksTag: "true"})
+
+	fakeAsgEbs.
+		On("modifyVolumeSize", defaultVolumeId, mock.AnythingOfType("int64")).
+		Return(nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeModified", defaultVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("luksOpen", "/dev/xvdc", "data", []byte("secret")).
+		Return(nil)
+	fakeAsgEbs.
+		On("luksResize", "data", []byte("secret")).
+		Return(nil)
+	fakeAsgEbs.
+		On("fileSystemSize", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(int64(100<<30), nil)
+	fakeAsgEbs.
+		On("deviceSize", mock.AnythingOfType("string")).
+		Return(int64(200<<30), nil)
+	fakeAsgEbs.
+		On("growFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "luksResize", "data", []byte("secret"))
+	fakeAsgEbs.AssertCalled(t, "growFileSystem", "/dev/mapper/data", *cfg.mountPoint, "ext4")
+}
+
+func TestRefuseLuksVolumeWithoutLuksName(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := newReattachFakeWithTags(200, map[string]string{fileSystemTypeTag: "ext4", luksTag: "true"})
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "mountVolume", 0)
+}
+
+func TestRefusePlainVolumeWithLuksName(t *testing.T) {
+	cfg, cleanup := newLuksConfig(t)
+	defer cleanup()
+	fakeAsgEbs := newReattachFake(200)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "luksOpen", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "mountVolume", 0)
+}
@@ -0,0 +1,294 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Tags of the volumes of an LVM volume group. All of them carry the random id
+// of their group, their index in it and the number of members of the group.
+const (
+	lvmGroupTag   = "lvm-volume-group"
+	lvmMemberTag  = "lvm-member"
+	lvmMembersTag = "lvm-members"
+)
+
+func (awsAsgEbs *AwsAsgEbs) createVolumeGroup(volumeGroup string, logicalVolume string, devices []string) error {
+	err := run("/sbin/pvcreate", devices...)
+	if err != nil {
+		return err
+	}
+	err = run("/sbin/vgcreate", append([]string{volumeGroup}, devices...)...)
+	if err != nil {
+		return err
+	}
+	return run("/sbin/lvcreate", "-l", "100%FREE", "-n", logicalVolume, volumeGroup)
+}
+
+func (awsAsgEbs *AwsAsgEbs) activateVolumeGroup(volumeGroup string) error {
+	return run("/sbin/vgchange", "-ay", volumeGroup)
+}
+
+func (awsAsgEbs *AwsAsgEbs) extendVolumeGroup(volumeGroup string, devices []string) error {
+	err := run("/sbin/pvcreate", devices...)
+	if err != nil {
+		return err
+	}
+	return run("/sbin/vgextend", append([]string{volumeGroup}, devices...)...)
+}
+
+func (awsAsgEbs *AwsAsgEbs) resizePhysicalVolume(device string) error {
+	return run("/sbin/pvresize", device)
+}
+
+func (awsAsgEbs *AwsAsgEbs) extendLogicalVolume(volumeGroup string, logicalVolume string) error {
+	return run("/sbin/lvextend", "-l", "+100%FREE", volumeGroup+"/"+logicalVolume)
+}
+
+func validateLvm(cfg Config) error {
+	if *cfg.lvmVolumes < 1 {
+		return errors.New("--lvm-volumes must be at least 1")
+	}
+	if *cfg.lvmVolumeGroup == "" {
+		if *cfg.lvmVolumes != 1 {
+			return errors.New("--lvm-volumes needs --lvm-volume-group")
+		}
+		return nil
+	}
+	if *cfg.raidDevices > 0 {
+		return errors.New("--lvm-volume-group cannot be combined with --raid-devices, use --lvm-volumes")
+	}
+	if *cfg.slots > 0 {
+		return errors.New("--lvm-volume-group cannot be combined with --slots")
+	}
+	// The members of a group are neither restored from snapshots nor migrated.
+	if *cfg.snapshotName != "" {
+		return errors.New("--lvm-volume-group cannot be combined with --snapshot-name")
+	}
+	if *cfg.migrateFromOtherAz {
+		return errors.New("--lvm-volume-group cannot be combined with --migrate-from-other-az")
+	}
+	return nil
+}
+
+// lvmMembers picks the volumes of an LVM volume group from the given volumes.
+// It returns the group id and the member volume ids ordered by index, or no
+// members if none of the volumes belongs to a group. A group with a missing
+// member is an error, as it could not be activated. The number of members is
+// the highest one recorded on them, as the members are only retagged after
+// the group was extended.
+func lvmMembers(volumes []*ec2.Volume) (string, []string, error) {
+	groups := map[string]map[int]string{}
+	counts := map[string]int{}
+	for _, volume := range volumes {
+		tags := map[string]string{}
+		for _, tag := range volume.Tags {
+			tags[*tag.Key] = *tag.Value
+		}
+		groupId, ok := tags[lvmGroupTag]
+		if !ok {
+			continue
+		}
+		index, err := strconv.Atoi(tags[lvmMemberTag])
+		if err != nil || index < 0 {
+			return "", nil, fmt.Errorf("volume %s has invalid %s tag '%s'", *volume.VolumeId, lvmMemberTag, tags[lvmMemberTag])
+		}
+		count, err := strconv.Atoi(tags[lvmMembersTag])
+		if err != nil || count <= index {
+			return "", nil, fmt.Errorf("volume %s has invalid %s tag '%s'", *volume.VolumeId, lvmMembersTag, tags[lvmMembersTag])
+		}
+		if groups[groupId] == nil {
+			groups[groupId] = map[int]string{}
+		}
+		groups[groupId][index] = *volume.VolumeId
+		if count > counts[groupId] {
+			counts[groupId] = count
+		}
+	}
+
+	groupIds := []string{}
+	for groupId := range groups {
+		groupIds = append(groupIds, groupId)
+	}
+	sort.Strings(groupIds)
+
+	var missingErr error
+	for _, groupId := range groupIds {
+		members := groups[groupId]
+		volumeIds := []string{}
+		for i := 0; i < counts[groupId]; i++ {
+			volumeId, ok := members[i]
+			if !ok {
+				missingErr = fmt.Errorf("member %d of volume group %s not found", i, groupId)
+				break
+			}
+			volumeIds = append(volumeIds, volumeId)
+		}
+		if len(volumeIds) == counts[groupId] {
+			return groupId, volumeIds, nil
+		}
+	}
+	return "", nil, missingErr
+}
+
+// setupVolumeGroup creates the LVM volume group on new volumes, or activates
+// the existing one on reattached volumes, and returns the device of the
+// logical volume.
+func setupVolumeGroup(asgEbs AsgEbs, cfg Config, devices []string, create bool) (string, error) {
+	volumeGroup := *cfg.lvmVolumeGroup
+	device := "/dev/" + volumeGroup + "/" + *cfg.lvmLogicalVolume
+
+	if create {
+		log.WithFields(log.Fields{"volume_group": volumeGroup, "devices": devices}).Info("Creating LVM volume group")
+		err := asgEbs.createVolumeGroup(volumeGroup, *cfg.lvmLogicalVolume, devices)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to create LVM volume group")
+			return "", err
+		}
+	} else {
+		log.WithFields(log.Fields{"volume_group": volumeGroup}).Info("Activating LVM volume group")
+		err := asgEbs.activateVolumeGroup(volumeGroup)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to activate LVM volume group")
+			return "", err
+		}
+	}
+
+	return device, nil
+}
+
+// runLvm puts the volumes into an LVM volume group with a single logical
+// volume. Existing volume groups are grown, by growing their volumes to
+// --create-size and by adding volumes up to --lvm-volumes. Volumes are never
+// removed from a volume group.
+func runLvm(asgEbs AsgEbs, cfg Config) error {
+	volumeGroup := *cfg.lvmVolumeGroup
+
+	volumes, attached, err := findMembers(asgEbs, cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to find volumes")
+		return err
+	}
+	groupId, volumeIds, err := lvmMembers(volumes)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Refusing to create LVM volume group")
+		return err
+	}
+
+	for _, volumeId := range volumeIds {
+		err = checkEncryption(asgEbs, cfg, volumeId)
+		if err != nil {
+			return err
+		}
+	}
+
+	count := *cfg.lvmVolumes
+	if len(volumeIds) > count {
+		count = len(volumeIds)
+	}
+	devices, err := memberDevices(*cfg.attachAs, count)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid LVM member device")
+		return err
+	}
+
+	create := volumeIds == nil
+	if create {
+		groupId, err = newArrayUuid()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to generate volume group id")
+			return err
+		}
+	}
+
+	device := "/dev/" + volumeGroup + "/" + *cfg.lvmLogicalVolume
+	grown := false
+	if !create {
+		blockDevices, err := attachMembers(asgEbs, cfg, volumeIds, devices, attached)
+		if err != nil {
+			return err
+		}
+		device, err = setupVolumeGroup(asgEbs, cfg, blockDevices, false)
+		if err != nil {
+			return err
+		}
+		for i, volumeId := range volumeIds {
+			volumeGrown, err := growVolume(asgEbs, cfg, volumeId)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": volumeId}).Warn("Failed to grow volume, using its current size")
+				continue
+			}
+			if !volumeGrown {
+				continue
+			}
+			log.WithFields(log.Fields{"device": blockDevices[i]}).Info("Resizing LVM physical volume")
+			err = asgEbs.resizePhysicalVolume(blockDevices[i])
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "device": blockDevices[i]}).Error("Failed to resize LVM physical volume")
+				return err
+			}
+			grown = true
+		}
+	}
+
+	if len(volumeIds) < count {
+		log.WithFields(log.Fields{"volume_group": volumeGroup, "group": groupId, "members": count - len(volumeIds)}).Info("Creating new LVM member volumes")
+		groupTags := map[string]string{lvmGroupTag: groupId, lvmMembersTag: strconv.Itoa(count)}
+		newVolumeIds, err := createMembers(asgEbs, cfg, groupTags, lvmMemberTag, len(volumeIds), count)
+		if err != nil {
+			return err
+		}
+		blockDevices, err := attachMembers(asgEbs, cfg, newVolumeIds, devices[len(volumeIds):], nil)
+		if err != nil {
+			return err
+		}
+		if create {
+			device, err = setupVolumeGroup(asgEbs, cfg, blockDevices, true)
+			if err != nil {
+				return err
+			}
+		} else {
+			log.WithFields(log.Fields{"volume_group": volumeGroup, "devices": blockDevices}).Info("Extending LVM volume group")
+			err = asgEbs.extendVolumeGroup(volumeGroup, blockDevices)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Failed to extend LVM volume group")
+				return err
+			}
+			// Only volumes tagged with a file system are found again, the
+			// old members get the new number of members afterwards.
+			for _, volumeId := range newVolumeIds {
+				err = asgEbs.tagVolume(volumeId, map[string]string{"filesystem": "true"})
+				if err != nil {
+					log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to tag volume")
+					return err
+				}
+			}
+			for _, volumeId := range volumeIds {
+				err = asgEbs.tagVolume(volumeId, map[string]string{lvmMembersTag: strconv.Itoa(count)})
+				if err != nil {
+					log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to tag volume")
+					return err
+				}
+			}
+			grown = true
+		}
+		volumeIds = append(volumeIds, newVolumeIds...)
+	}
+
+	if grown {
+		log.WithFields(log.Fields{"volume_group": volumeGroup, "logical_volume": *cfg.lvmLogicalVolume}).Info("Extending LVM logical volume")
+		err = asgEbs.extendLogicalVolume(volumeGroup, *cfg.lvmLogicalVolume)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to extend LVM logical volume")
+			return err
+		}
+	}
+
+	return mountMembers(asgEbs, cfg, device, volumeIds, create, grown)
+}
@@ -0,0 +1,291 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const defaultGroupId = "89abcdef:01234567:89abcdef:01234567"
+
+func lvmVolume(volumeId string, groupId string, member int, members int) *ec2.Volume {
+	return &ec2.Volume{
+		VolumeId: aws.String(volumeId),
+		Size:     aws.Int64(200),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("my-name")},
+			{Key: aws.String(lvmGroupTag), Value: aws.String(groupId)},
+			{Key: aws.String(lvmMemberTag), Value: aws.String(fmt.Sprintf("%d", member))},
+			{Key: aws.String(lvmMembersTag), Value: aws.String(fmt.Sprintf("%d", members))},
+		},
+	}
+}
+
+func newLvmConfig() *Config {
+	cfg := newConfig()
+	cfg.attachAs = strPtr("xvdf")
+	cfg.lvmVolumeGroup = strPtr("vg0")
+	cfg.lvmVolumes = intPtr(2)
+	return cfg
+}
+
+func TestLvmMembersOrderedByIndex(t *testing.T) {
+	groupId, members, err := lvmMembers([]*ec2.Volume{
+		lvmVolume("vol-1", defaultGroupId, 1, 2),
+		lvmVolume("vol-0", defaultGroupId, 0, 2),
+		raidVolume("vol-2", defaultArrayUuid, 0),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultGroupId, groupId)
+	assert.Equal(t, []string{"vol-0", "vol-1"}, members)
+}
+
+func TestLvmMembersRefusesMissingMember(t *testing.T) {
+	_, members, err := lvmMembers([]*ec2.Volume{
+		lvmVolume("vol-0", defaultGroupId, 0, 3),
+		lvmVolume("vol-2", defaultGroupId, 2, 3),
+	})
+
+	assert.Error(t, err)
+	assert.Nil(t, members)
+}
+
+func TestLvmMembersRefusesMissingLastMember(t *testing.T) {
+	_, members, err := lvmMembers([]*ec2.Volume{
+		lvmVolume("vol-0", defaultGroupId, 0, 3),
+		lvmVolume("vol-1", defaultGroupId, 1, 3),
+	})
+
+	assert.Error(t, err)
+	assert.Nil(t, members)
+}
+
+func TestLvmMembersTakeHighestMemberCount(t *testing.T) {
+	// The first member was not retagged yet after the group was extended.
+	_, members, err := lvmMembers([]*ec2.Volume{
+		lvmVolume("vol-0", defaultGroupId, 0, 1),
+		lvmVolume("vol-1", defaultGroupId, 1, 2),
+	})
+
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"vol-0", "vol-1"}, members)
+}
+
+func TestValidateLvmRefusesRaidDevices(t *testing.T) {
+	cfg := newLvmConfig()
+	cfg.raidDevices = intPtr(2)
+
+	assert.Error(t, validateLvm(*cfg))
+}
+
+func TestValidateLvmRefusesSingleVolumeOptions(t *testing.T) {
+	cfg := newLvmConfig()
+	assert.NoError(t, validateLvm(*cfg))
+
+	cfg.snapshotName = strPtr("my-name")
+	assert.Error(t, validateLvm(*cfg))
+
+	cfg = newLvmConfig()
+	cfg.migrateFromOtherAz = boolPtr(true)
+	assert.Error(t, validateLvm(*cfg))
+}
+
+func TestCreateVolumeGroupOnNewVolumes(t *testing.T) {
+	cfg := newLvmConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolumes", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{}, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("createVolumeGroup", "vg0", "data", mock.AnythingOfType("[]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, mock.AnythingOfType("map[string]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 2)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, mock.MatchedBy(func(tags map[string]string) bool {
+		return tags[lvmGroupTag] != "" && tags[lvmMemberTag] == "1" && tags[raidArrayTag] == ""
+	}), (*string)(nil), VolumeOptions{})
+	fakeAsgEbs.AssertCalled(t, "createVolumeGroup", "vg0", "data", []string{"/dev/xvdf", "/dev/xvdg"})
+	fakeAsgEbs.AssertNumberOfCalls(t, "activateVolumeGroup", 0)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", "/dev/vg0/data", *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/vg0/data", *cfg.mountPoint, *cfg.fileSystem, "")
+}
+
+func TestActivateVolumeGroupOnFoundVolumes(t *testing.T) {
+	cfg := newLvmConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolumes", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{
+			lvmVolume("vol-0", defaultGroupId, 0, 2),
+			lvmVolume("vol-1", defaultGroupId, 1, 2),
+		}, nil)
+	fakeAsgEbs.
+		On("attachVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("activateVolumeGroup", "vg0").
+		Return(nil)
+	fakeAsgEbs.
+		On("describeVolume", mock.AnythingOfType("string")).
+		Return(&ec2.Volume{Size: aws.Int64(200)}, nil)
+	fakeAsgEbs.
+		On("volumeTags", mock.AnythingOfType("string")).
+		Return(map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-0", "xvdf", *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-1", "xvdg", *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolumeGroup", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "extendLogicalVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "makeFileSystem", 0)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/vg0/data", *cfg.mountPoint, "ext4", "")
+}
+
+func TestExtendVolumeGroupWithNewVolume(t *testing.T) {
+	cfg := newLvmConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolumes", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{lvmVolume("vol-0", defaultGroupId, 0, 1)}, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return("vol-1", nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("activateVolumeGroup", "vg0").
+		Return(nil)
+	fakeAsgEbs.
+		On("describeVolume", mock.AnythingOfType("string")).
+		Return(&ec2.Volume{Size: aws.Int64(200)}, nil)
+	fakeAsgEbs.
+		On("extendVolumeGroup", "vg0", mock.AnythingOfType("[]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", "vol-1", map[string]string{"filesystem": "true"}).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", "vol-0", map[string]string{lvmMembersTag: "2"}).
+		Return(nil)
+	fakeAsgEbs.
+		On("extendLogicalVolume", "vg0", "data").
+		Return(nil)
+	fakeAsgEbs.
+		On("volumeTags", mock.AnythingOfType("string")).
+		Return(map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+	fakeAsgEbs.
+		On("fileSystemSize", "/dev/vg0/data", *cfg.mountPoint, "ext4").
+		Return(int64(200<<30), nil)
+	fakeAsgEbs.
+		On("deviceSize", "/dev/vg0/data").
+		Return(int64(400<<30), nil)
+	fakeAsgEbs.
+		On("growFileSystem", "/dev/vg0/data", *cfg.mountPoint, "ext4").
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, map[string]string{lvmGroupTag: defaultGroupId, lvmMemberTag: "1", lvmMembersTag: "2"}, (*string)(nil), VolumeOptions{})
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-1", "xvdg", *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "extendVolumeGroup", "vg0", []string{"/dev/xvdg"})
+	fakeAsgEbs.AssertCalled(t, "tagVolume", "vol-0", map[string]string{lvmMembersTag: "2"})
+	fakeAsgEbs.AssertCalled(t, "extendLogicalVolume", "vg0", "data")
+	fakeAsgEbs.AssertNumberOfCalls(t, "makeFileSystem", 0)
+	fakeAsgEbs.AssertCalled(t, "growFileSystem", "/dev/vg0/data", *cfg.mountPoint, "ext4")
+}
+
+func TestGrowVolumeGroupVolumes(t *testing.T) {
+	cfg := newLvmConfig()
+	cfg.lvmVolumes = intPtr(1)
+	cfg.growFileSystem = boolPtr(false)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolumes", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{lvmVolume("vol-0", defaultGroupId, 0, 1)}, nil)
+	fakeAsgEbs.
+		On("attachVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("activateVolumeGroup", "vg0").
+		Return(nil)
+	fakeAsgEbs.
+		On("describeVolume", "vol-0").
+		Return(&ec2.Volume{Size: aws.Int64(100)}, nil)
+	fakeAsgEbs.
+		On("modifyVolumeSize", "vol-0", *cfg.createSize).
+		Return(nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeModified", "vol-0").
+		Return(nil)
+	fakeAsgEbs.
+		On("resizePhysicalVolume", "/dev/xvdf").
+		Return(nil)
+	fakeAsgEbs.
+		On("extendLogicalVolume", "vg0", "data").
+		Return(nil)
+	fakeAsgEbs.
+		On("volumeTags", mock.AnythingOfType("string")).
+		Return(map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "resizePhysicalVolume", "/dev/xvdf")
+	fakeAsgEbs.AssertCalled(t, "extendLogicalVolume", "vg0", "data")
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io/ioutil"
+	"net/url"
 	"os"
 	"os/exec"
 	"sort"
@@ -33,19 +34,6 @@ func (s ByStartTime) Len() int           { return len(s) }
 func (s ByStartTime) Swap(i, j int)      { s[i], s[j] = s[j], s[i] }
 func (s ByStartTime) Less(i, j int) bool { return (*s[i].StartTime).Before(*s[j].StartTime) }
 
-func waitForFile(file string, timeout time.Duration) error {
-	startTime := time.Now()
-	if _, err := os.Stat(file); err == nil {
-		return nil
-	}
-	newTimeout := timeout - time.Since(startTime)
-	if newTimeout > 0 {
-		return waitForFile(file, newTimeout)
-	} else {
-		return errors.New("File " + file + " not found")
-	}
-}
-
 func run(cmd string, args ...string) error {
 	log.WithFields(log.Fields{"cmd": cmd, "args": args}).Info("Running command")
 	out, err := exec.Command(cmd, args...).CombinedOutput()
@@ -56,6 +44,16 @@ func run(cmd string, args ...string) error {
 	return nil
 }
 
+func output(cmd string, args ...string) (string, error) {
+	log.WithFields(log.Fields{"cmd": cmd, "args": args}).Info("Running command")
+	out, err := exec.Command(cmd, args...).Output()
+	if err != nil {
+		log.WithFields(log.Fields{"cmd": cmd, "args": args, "err": err}).Info("Error running command")
+		return "", err
+	}
+	return string(out), nil
+}
+
 func slurpFile(file string) string {
 	v, err := ioutil.ReadFile(file)
 	if err != nil {
@@ -69,11 +67,59 @@ type AsgEbs interface {
 	checkMountPoint(mountPoint string) error
 	findVolume(tagKey string, tagValue string) (*string, error)
 	attachVolume(volumeId string, attachAs string, deleteOnTermination bool) error
+	volumeDevice(volumeId string, attachAs string, timeout time.Duration) (string, error)
 	findSnapshot(tagKey string, tagValue string) (*string, error)
-	createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string) (*string, error)
-	mountVolume(device string, mountPoint string) error
-	makeFileSystem(device string, mkfsInodeRatio int64, volumeId string) error
+	createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string, options VolumeOptions) (*string, error)
+	mountVolume(device string, mountPoint string, fileSystem string, options string) error
+	detectFileSystem(device string) (string, error)
+	fileSystemUuid(device string) (string, error)
+	makeFileSystem(device string, fileSystem string, mkfsArgs []string, volumeId string) error
 	waitUntilVolumeAvailable(volumeId string) error
+	findAttachedVolume(attachAs string) (*string, error)
+	unmountVolume(mountPoint string) error
+	detachVolume(volumeId string, attachAs string) error
+	deviceStack(mountPoint string) (DeviceStack, error)
+	closeDevice(device string) error
+	findDeviceVolume(device string) (*string, error)
+	tagVolume(volumeId string, tags map[string]string) error
+	untagVolume(volumeId string, keys []string) error
+	findInstanceVolume(tagKey string, tagValue string) (*string, error)
+	findInstanceVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error)
+	createSnapshot(volumeId string, snapshotName string, createTags map[string]string) (*string, error)
+	waitUntilSnapshotCompleted(snapshotId string) error
+	listSnapshots(tagKey string, tagValue string) ([]*ec2.Snapshot, error)
+	deleteSnapshot(snapshotId string) error
+	findVolumesInOtherAz(tagKey string, tagValue string) ([]*ec2.Volume, error)
+	volumeTags(volumeId string) (map[string]string, error)
+	deleteVolume(volumeId string) error
+	findVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error)
+	describeVolume(volumeId string) (*ec2.Volume, error)
+	describeSnapshot(snapshotId string) (*ec2.Snapshot, error)
+	copySnapshot(snapshotId string, options VolumeOptions) (*string, error)
+	createRaid(device string, arrayUuid string, members []string) error
+	assembleRaid(device string, arrayUuid string, members []string) error
+	createVolumeGroup(volumeGroup string, logicalVolume string, devices []string) error
+	activateVolumeGroup(volumeGroup string) error
+	extendVolumeGroup(volumeGroup string, devices []string) error
+	resizePhysicalVolume(device string) error
+	extendLogicalVolume(volumeGroup string, logicalVolume string) error
+	luksFormat(device string, key []byte) error
+	luksOpen(device string, name string, key []byte) error
+	luksResize(name string, key []byte) error
+	isLuks(device string) (bool, error)
+	persistLuks(device string, name string, keyFile string) error
+	modifyVolumeSize(volumeId string, size int64) error
+	waitUntilVolumeModified(volumeId string) error
+	fileSystemSize(device string, mountPoint string, fileSystem string) (int64, error)
+	deviceSize(device string) (int64, error)
+	growFileSystem(device string, mountPoint string, fileSystem string) error
+	persistMount(device string, mountPoint string, fileSystem string, options string, mode string) error
+	checkFileSystem(device string, fileSystem string, policy string) (string, error)
+	setMountPointOwnership(mountPoint string, owner string, group string, mode string) error
+	instanceId() string
+	findCreatedVolumes(createdFor string) ([]*ec2.Volume, error)
+	findSlotVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error)
+	instanceTag(key string) (string, error)
 }
 
 type AwsAsgEbs struct {
@@ -118,6 +164,17 @@ func NewAwsAsgEbs(maxRetries int) *AwsAsgEbs {
 }
 
 func (awsAsgEbs *AwsAsgEbs) findVolume(tagKey string, tagValue string) (*string, error) {
+	volumes, err := awsAsgEbs.findVolumes(tagKey, tagValue)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, nil
+	}
+	return volumes[0].VolumeId, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) findVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error) {
 	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
 
 	params := &ec2.DescribeVolumesInput{
@@ -153,13 +210,24 @@ func (awsAsgEbs *AwsAsgEbs) findVolume(tagKey string, tagValue string) (*string,
 	if err != nil {
 		return nil, err
 	}
-	if len(describeVolumesOutput.Volumes) == 0 {
+	return describeVolumesOutput.Volumes, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) findSnapshot(tagKey string, tagValue string) (*string, error) {
+	snapshots, err := awsAsgEbs.listSnapshots(tagKey, tagValue)
+	if err != nil {
+		return nil, err
+	}
+	sort.Sort(sort.Reverse(ByStartTime(snapshots)))
+
+	if len(snapshots) == 0 {
 		return nil, nil
 	}
-	return describeVolumesOutput.Volumes[0].VolumeId, nil
+
+	return snapshots[0].SnapshotId, nil
 }
 
-func (awsAsgEbs *AwsAsgEbs) findSnapshot(tagKey string, tagValue string) (*string, error) {
+func (awsAsgEbs *AwsAsgEbs) listSnapshots(tagKey string, tagValue string) ([]*ec2.Snapshot, error) {
 	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
 
 	describeSnapshotsInput := &ec2.DescribeSnapshotsInput{
@@ -182,17 +250,46 @@ func (awsAsgEbs *AwsAsgEbs) findSnapshot(tagKey string, tagValue string) (*strin
 	if err != nil {
 		return nil, err
 	}
-	snapshots := describeSnapshotsOutput.Snapshots
-	sort.Sort(sort.Reverse(ByStartTime(snapshots)))
+	return restorableSnapshots(describeSnapshotsOutput.Snapshots), nil
+}
 
-	if len(snapshots) == 0 {
-		return nil, nil
+// restorableSnapshots leaves out transient snapshots, which are deleted once
+// the volume they were taken for is available.
+func restorableSnapshots(snapshots []*ec2.Snapshot) []*ec2.Snapshot {
+	restorable := []*ec2.Snapshot{}
+	for _, snapshot := range snapshots {
+		transient := false
+		for _, tag := range snapshot.Tags {
+			if *tag.Key == transientTag {
+				transient = true
+			}
+		}
+		if !transient {
+			restorable = append(restorable, snapshot)
+		}
 	}
+	return restorable
+}
 
-	return snapshots[0].SnapshotId, nil
+// VolumeOptions holds the settings of new volumes which are not reflected in
+// their tags.
+type VolumeOptions struct {
+	Encrypted  bool
+	KmsKeyId   string
+	Iops       int64
+	Throughput int64
+}
+
+func volumeOptions(cfg Config) VolumeOptions {
+	return VolumeOptions{
+		Encrypted:  *cfg.encrypted || *cfg.kmsKeyId != "",
+		KmsKeyId:   *cfg.kmsKeyId,
+		Iops:       *cfg.iops,
+		Throughput: *cfg.throughput,
+	}
 }
 
-func (awsAsgEbs *AwsAsgEbs) createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string) (*string, error) {
+func (awsAsgEbs *AwsAsgEbs) createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string, options VolumeOptions) (*string, error) {
 	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
 
 	filesystem := "false"
@@ -203,39 +300,52 @@ func (awsAsgEbs *AwsAsgEbs) createVolume(createSize int64, createName string, cr
 		VolumeType:       aws.String(createVolumeType),
 	}
 
+	if options.Encrypted {
+		createVolumeInput.Encrypted = aws.Bool(true)
+		if options.KmsKeyId != "" {
+			createVolumeInput.KmsKeyId = aws.String(options.KmsKeyId)
+		}
+	}
+
+	if options.Iops > 0 {
+		createVolumeInput.Iops = aws.Int64(options.Iops)
+	}
+
 	if snapshotId != nil {
 		createVolumeInput.SnapshotId = aws.String(*snapshotId)
 		filesystem = "true"
 	}
 
-	vol, err := svc.CreateVolume(createVolumeInput)
+	req, vol := svc.CreateVolumeRequest(createVolumeInput)
+	if options.Throughput > 0 {
+		req.Handlers.Build.PushBack(withQueryParams(url.Values{
+			"Throughput": {fmt.Sprintf("%d", options.Throughput)},
+		}))
+	}
+	err := req.Send()
 	if err != nil {
 		return nil, err
 	}
-	tags := []*ec2.Tag{
-		{
-			Key:   aws.String("Name"),
-			Value: aws.String(createName),
-		},
-		{
-			Key:   aws.String("filesystem"),
-			Value: aws.String(filesystem),
-		},
+	// Volumes restored from a snapshot keep the tags describing their data,
+	// like the file system type and UUID.
+	tags := map[string]string{}
+	if snapshotId != nil {
+		snapshot, err := awsAsgEbs.describeSnapshot(*snapshotId)
+		if err != nil {
+			return vol.VolumeId, err
+		}
+		for _, tag := range snapshot.Tags {
+			tags[*tag.Key] = *tag.Value
+		}
+		tags = dataTags(tags)
 	}
+	tags["Name"] = createName
+	tags["filesystem"] = filesystem
 	for k, v := range createTags {
-		tags = append(tags,
-			&ec2.Tag{
-				Key:   aws.String(k),
-				Value: aws.String(v),
-			},
-		)
+		tags[k] = v
 	}
 
-	createTagsInput := &ec2.CreateTagsInput{
-		Resources: []*string{vol.VolumeId},
-		Tags:      tags,
-	}
-	_, err = svc.CreateTags(createTagsInput)
+	err = tagResource(svc, *vol.VolumeId, tags)
 	if err != nil {
 		return vol.VolumeId, err
 	}
@@ -297,18 +407,17 @@ func (awsAsgEbs *AwsAsgEbs) attachVolume(volumeId string, attachAs string, delet
 		}
 	}
 
-	err = waitForFile("/dev/"+attachAs, 60*time.Second)
-	if err != nil {
-		return err
-	}
-
 	return nil
 }
 
-func (awsAsgEbs *AwsAsgEbs) makeFileSystem(device string, mkfsInodeRatio int64, volumeId string) error {
+func (awsAsgEbs *AwsAsgEbs) makeFileSystem(device string, fileSystem string, mkfsArgs []string, volumeId string) error {
 	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
 
-	err := run("/usr/sbin/mkfs.ext4", "-i", fmt.Sprintf("%d", mkfsInodeRatio), device)
+	uuid, err := newFileSystemUuid()
+	if err != nil {
+		return err
+	}
+	err = run(fileSystems[fileSystem].Mkfs, append(append(mkfsArgs, uuidArgs(fileSystem, uuid)...), device)...)
 	if err != nil {
 		return err
 	}
@@ -317,6 +426,14 @@ func (awsAsgEbs *AwsAsgEbs) makeFileSystem(device string, mkfsInodeRatio int64,
 			Key:   aws.String("filesystem"),
 			Value: aws.String("true"),
 		},
+		{
+			Key:   aws.String(fileSystemTypeTag),
+			Value: aws.String(fileSystem),
+		},
+		{
+			Key:   aws.String(fileSystemUuidTag),
+			Value: aws.String(uuid),
+		},
 	}
 	createTagsInput := &ec2.CreateTagsInput{
 		Resources: []*string{aws.String(volumeId)},
@@ -329,12 +446,57 @@ func (awsAsgEbs *AwsAsgEbs) makeFileSystem(device string, mkfsInodeRatio int64,
 	return nil
 }
 
-func (awsAsgEbs *AwsAsgEbs) mountVolume(device string, mountPoint string) error {
+func (awsAsgEbs *AwsAsgEbs) tagVolume(volumeId string, tags map[string]string) error {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+	return tagResource(svc, volumeId, tags)
+}
+
+func (awsAsgEbs *AwsAsgEbs) untagVolume(volumeId string, keys []string) error {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	ec2Tags := []*ec2.Tag{}
+	for _, k := range keys {
+		ec2Tags = append(ec2Tags, &ec2.Tag{Key: aws.String(k)})
+	}
+	deleteTagsInput := &ec2.DeleteTagsInput{
+		Resources: []*string{aws.String(volumeId)},
+		Tags:      ec2Tags,
+	}
+	_, err := svc.DeleteTags(deleteTagsInput)
+	return err
+}
+
+func tagResource(svc *ec2.EC2, resourceId string, tags map[string]string) error {
+	ec2Tags := []*ec2.Tag{}
+	for k, v := range tags {
+		ec2Tags = append(ec2Tags,
+			&ec2.Tag{
+				Key:   aws.String(k),
+				Value: aws.String(v),
+			},
+		)
+	}
+	createTagsInput := &ec2.CreateTagsInput{
+		Resources: []*string{aws.String(resourceId)},
+		Tags:      ec2Tags,
+	}
+	_, err := svc.CreateTags(createTagsInput)
+	return err
+}
+
+func (awsAsgEbs *AwsAsgEbs) mountVolume(device string, mountPoint string, fileSystem string, options string) error {
 	err := os.MkdirAll(mountPoint, 0755)
 	if err != nil {
 		return err
 	}
-	return run("/bin/mount", device, mountPoint)
+	args := []string{}
+	if fileSystem != "" {
+		args = append(args, "-t", fileSystem)
+	}
+	if options != "" {
+		args = append(args, "-o", options)
+	}
+	return run("/bin/mount", append(args, device, mountPoint)...)
 }
 
 func (awsAsgEbs *AwsAsgEbs) checkDevice(device string) error {
@@ -345,7 +507,11 @@ func (awsAsgEbs *AwsAsgEbs) checkDevice(device string) error {
 }
 
 func (awsAsgEbs *AwsAsgEbs) checkMountPoint(mountPoint string) error {
-	if strings.Contains(slurpFile("/proc/mounts"), mountPoint) {
+	mounted, err := isMounted(mountPoint)
+	if err != nil {
+		return err
+	}
+	if mounted {
 		return errors.New("Already mounted")
 	}
 	return nil
@@ -375,123 +541,424 @@ func CreateTags(s kingpin.Settings) (target *map[string]string) {
 	return
 }
 
-func runAsgEbs(asgEbs AsgEbs, cfg Config) {
+func runAsgEbs(asgEbs AsgEbs, cfg Config) error {
 
 	createFileSystemOnVolume := false
+	createdFromSnapshot := false
 	var volumeId *string
 	var snapshotId *string
+	var sourceVolumeId *string
+	var transientSnapshotIds []string
+	createTags := *cfg.createTags
 	attachAsDevice := "/dev/" + *cfg.attachAs
 
 	// Precondition checks
-	err := asgEbs.checkDevice(attachAsDevice)
+	mountedVolumeId, attachedVolumeId, err := checkPreconditions(asgEbs, cfg)
+	if err != nil {
+		return err
+	}
+	if mountedVolumeId != nil {
+		return exportMountedSlot(asgEbs, cfg, *mountedVolumeId)
+	}
+	volumeId = attachedVolumeId
+
+	err = validateVolumeType(*cfg.createVolumeType, *cfg.createSize, volumeOptions(cfg))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume_type": *cfg.createVolumeType}).Error("Invalid volume settings")
+		return err
+	}
+
+	err = validateLuks(cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid LUKS settings")
+		return err
+	}
+
+	err = validateMountOwnership(cfg)
 	if err != nil {
-		log.WithFields(log.Fields{"device": attachAsDevice}).Fatal("Device already exists")
+		log.WithFields(log.Fields{"error": err}).Error("Invalid mount point ownership")
+		return err
 	}
 
-	err = asgEbs.checkMountPoint(*cfg.mountPoint)
+	err = validateSlots(cfg)
 	if err != nil {
-		log.WithFields(log.Fields{"mount_point": *cfg.mountPoint}).Fatal("Already mounted")
+		log.WithFields(log.Fields{"error": err}).Error("Invalid slot settings")
+		return err
 	}
 
-	if *cfg.snapshotName == "" {
-		for i := 1; i <= 10; i++ {
-			volumeId, err = asgEbs.findVolume(*cfg.tagKey, *cfg.tagValue)
+	err = validateRaid(cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid RAID settings")
+		return err
+	}
+
+	err = validateLvm(cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid LVM settings")
+		return err
+	}
+
+	if *cfg.raidDevices > 0 {
+		return runRaid(asgEbs, cfg)
+	}
+	if *cfg.lvmVolumeGroup != "" {
+		return runLvm(asgEbs, cfg)
+	}
+
+	slot := noSlot
+	// Slots lost to other instances creating their volume at the same time.
+	takenSlots := map[int]bool{}
+	grown := false
+	for {
+		if volumeId == nil && *cfg.slots > 0 {
+			slot, volumeId, createFileSystemOnVolume, err = attachSlotVolume(asgEbs, cfg, takenSlots)
 			if err != nil {
-				log.WithFields(log.Fields{"error": err}).Fatal("Failed to find volume")
+				return err
 			}
-			if volumeId == nil {
-				break
-			} else {
-				log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice, "attempt": i}).Info("Trying to attach existing volume")
-				err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+		} else if volumeId == nil && *cfg.snapshotName == "" {
+			claimer := newVolumeClaimer(asgEbs, cfg)
+			for i := 1; i <= 10; i++ {
+				volumeId, err = claimer.findVolume()
 				if err != nil {
-					log.WithFields(log.Fields{"error": err}).Warn("Failed to attach volume")
-				} else {
+					log.WithFields(log.Fields{"error": err}).Error("Failed to find volume")
+					return err
+				}
+				if volumeId == nil {
 					break
+				} else {
+					err = checkEncryption(asgEbs, cfg, *volumeId)
+					if err != nil {
+						return err
+					}
+					log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice, "attempt": i}).Info("Trying to attach existing volume")
+					err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+					if err != nil {
+						log.WithFields(log.Fields{"error": err}).Warn("Failed to attach volume")
+						claimer.skip(*volumeId)
+					} else {
+						break
+					}
 				}
 			}
 		}
-	} else {
-		snapshotId, err = asgEbs.findSnapshot("Name", *cfg.snapshotName)
-		if err != nil {
-			log.WithFields(log.Fields{"error": err, "snapshot_name": *cfg.snapshotName}).Fatal("Failed to find snapshot")
+		if volumeId == nil && *cfg.snapshotName != "" {
+			snapshotId, err = asgEbs.findSnapshot("Name", *cfg.snapshotName)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "snapshot_name": *cfg.snapshotName}).Error("Failed to find snapshot")
+				return err
+			}
+		}
+
+		if volumeId != nil {
+			grown, err = growVolume(asgEbs, cfg, *volumeId)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Warn("Failed to grow volume, using its current size")
+			}
+		}
+
+		if volumeId == nil && *cfg.snapshotName == "" && *cfg.migrateFromOtherAz {
+			sourceVolumeId, snapshotId, createTags, err = snapshotVolumeFromOtherAz(asgEbs, cfg)
+			if err != nil {
+				return err
+			}
+			if snapshotId != nil {
+				transientSnapshotIds = append(transientSnapshotIds, *snapshotId)
+			}
+		}
+
+		if volumeId == nil && snapshotId != nil && volumeOptions(cfg).Encrypted {
+			encryptedSnapshotId, err := encryptedSnapshot(asgEbs, cfg, *snapshotId)
+			if err != nil {
+				return err
+			}
+			if *encryptedSnapshotId != *snapshotId {
+				transientSnapshotIds = append(transientSnapshotIds, *encryptedSnapshotId)
+			}
+			snapshotId = encryptedSnapshotId
+		}
+
+		if volumeId == nil {
+			log.Info("Creating new volume")
+			volumeId, err = asgEbs.createVolume(*cfg.createSize, *cfg.createName, *cfg.createVolumeType, creationTags(asgEbs, cfg, createTags, slot), snapshotId, volumeOptions(cfg))
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Failed to create new volume")
+				return err
+			}
+			log.WithFields(log.Fields{"volume": *volumeId}).Info("Waiting until new volume is available")
+			err = asgEbs.waitUntilVolumeAvailable(*volumeId)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Error("Waiting for volume timed out")
+				return err
+			}
+			deleteTransientSnapshots(asgEbs, transientSnapshotIds)
+			kept, err := deduplicateCreation(asgEbs, cfg, *volumeId, slot)
+			if err != nil {
+				return err
+			}
+			if !kept && slot == noSlot {
+				return fmt.Errorf("volume for %s is created by another instance", createdFor(cfg, slot))
+			}
+			if !kept {
+				log.WithFields(log.Fields{"slot": slot}).Info("Slot was taken by another instance, trying the next one")
+				takenSlots[slot] = true
+				volumeId, snapshotId, sourceVolumeId, transientSnapshotIds, createTags = nil, nil, nil, nil, *cfg.createTags
+				continue
+			}
+			if snapshotId == nil {
+				createFileSystemOnVolume = true
+			} else {
+				createdFromSnapshot = true
+			}
+			log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice}).Info("Attaching volume")
+			err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Failed to attach volume")
+				return err
+			}
 		}
+		break
+	}
+
+	device, err := asgEbs.volumeDevice(*volumeId, *cfg.attachAs, *cfg.deviceTimeout)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Error("Attached volume did not show up")
+		return err
+	}
+	device, err = setupLuks(asgEbs, cfg, device, []string{*volumeId}, createFileSystemOnVolume)
+	if err != nil {
+		return err
 	}
 
-	if volumeId == nil {
-		log.Info("Creating new volume")
-		volumeId, err = asgEbs.createVolume(*cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, snapshotId)
+	fileSystem := *cfg.fileSystem
+	if createFileSystemOnVolume {
+		log.WithFields(log.Fields{"device": device, "filesystem": fileSystem}).Info("Creating file system on new volume")
+		err = asgEbs.makeFileSystem(device, fileSystem, mkfsArgs(cfg), *volumeId)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Fatal("Failed to create new volume")
+			log.WithFields(log.Fields{"error": err}).Error("Failed to create file system")
+			return err
 		}
-		log.WithFields(log.Fields{"volume": *volumeId}).Info("Waiting until new volume is available")
-		err = asgEbs.waitUntilVolumeAvailable(*volumeId)
+	} else {
+		fileSystem, err = volumeFileSystem(asgEbs, *volumeId, device)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Fatal("Waiting for volume timed out")
+			return err
 		}
-		if snapshotId == nil {
-			createFileSystemOnVolume = true
+		err = verifyFileSystemUuid(asgEbs, *volumeId, device)
+		if err != nil {
+			return err
 		}
-		log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice}).Info("Attaching volume")
-		err = asgEbs.attachVolume(*volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+		err = checkVolumeFileSystem(asgEbs, cfg, device, fileSystem, []string{*volumeId})
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Fatal("Failed to attach volume")
+			return err
 		}
 	}
 
-	if createFileSystemOnVolume {
-		log.WithFields(log.Fields{"device": attachAsDevice}).Info("Creating file system on new volume")
-		err = asgEbs.makeFileSystem(attachAsDevice, *cfg.mkfsInodeRatio, *volumeId)
+	err = mountFileSystem(asgEbs, cfg, device, fileSystem, []string{*volumeId})
+	if err != nil {
+		return err
+	}
+
+	err = applyMountOwnership(asgEbs, cfg, createFileSystemOnVolume)
+	if err != nil {
+		return err
+	}
+
+	if *cfg.growFileSystem && (grown || createdFromSnapshot) {
+		err = growVolumeFileSystem(asgEbs, cfg, device, fileSystem)
 		if err != nil {
-			log.WithFields(log.Fields{"error": err}).Fatal("Failed to create file system")
+			log.WithFields(log.Fields{"error": err, "device": device}).Warn("Failed to grow file system")
 		}
 	}
 
-	log.WithFields(log.Fields{"device": attachAsDevice, "mount_point": *cfg.mountPoint}).Info("Mounting volume")
-	err = asgEbs.mountVolume(attachAsDevice, *cfg.mountPoint)
+	err = persistVolumeMount(asgEbs, cfg, device, fileSystem)
 	if err != nil {
-		log.WithFields(log.Fields{"error": err}).Fatal("Failed to mount volume")
+		return err
 	}
 
+	// The source volume is only retired once its data is mounted here.
+	if sourceVolumeId != nil && *cfg.retireMigratedVolume {
+		log.WithFields(log.Fields{"volume": *sourceVolumeId}).Info("Deleting migrated source volume")
+		err = asgEbs.deleteVolume(*sourceVolumeId)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": *sourceVolumeId}).Warn("Failed to delete migrated source volume")
+		}
+	}
+
+	if attachedVolumeId != nil {
+		return exportMountedSlot(asgEbs, cfg, *attachedVolumeId)
+	}
+	return exportSlot(cfg, slot)
 }
 
 type Config struct {
-	tagKey              *string
-	tagValue            *string
-	attachAs            *string
-	mountPoint          *string
-	createSize          *int64
-	mkfsInodeRatio      *int64
-	createName          *string
-	createVolumeType    *string
-	createTags          *map[string]string
-	deleteOnTermination *bool
-	snapshotName        *string
-	maxRetries          *int
+	tagKey               *string
+	tagValue             *string
+	attachAs             *string
+	mountPoint           *string
+	fsck                 *string
+	mountOptions         *string
+	readOnly             *bool
+	mountOwner           *string
+	mountGroup           *string
+	mountMode            *string
+	enforceOwnership     *bool
+	persistMount         *string
+	createSize           *int64
+	mkfsInodeRatio       *int64
+	fileSystem           *string
+	fileSystemLabel      *string
+	mkfsOptions          *string
+	growFileSystem       *bool
+	createName           *string
+	createVolumeType     *string
+	iops                 *int64
+	throughput           *int64
+	createTags           *map[string]string
+	deleteOnTermination  *bool
+	deviceTimeout        *time.Duration
+	claimTtl             *time.Duration
+	claimDelay           *time.Duration
+	creationWindow       *time.Duration
+	slots                *int
+	firstSlot            *int
+	slotFromTag          *string
+	slotFile             *string
+	encrypted            *bool
+	kmsKeyId             *string
+	snapshotName         *string
+	migrateFromOtherAz   *bool
+	retireMigratedVolume *bool
+	raidDevices          *int
+	raidDevice           *string
+	lvmVolumeGroup       *string
+	lvmVolumes           *int
+	lvmLogicalVolume     *string
+	luksName             *string
+	luksKeyFile          *string
+	luksKeyCommand       *string
+	maxRetries           *int
+}
+
+type flagger interface {
+	Flag(name, help string) *kingpin.FlagClause
+}
+
+func attachFlags(f flagger) *Config {
+	return &Config{
+		tagKey:               f.Flag("tag-key", "The tag key to search for").Required().PlaceHolder("KEY").String(),
+		tagValue:             f.Flag("tag-value", "The tag value to search for").Required().PlaceHolder("VALUE").String(),
+		attachAs:             f.Flag("attach-as", "device name e.g. xvdb, the volume is looked up by id if it shows up as an NVMe device instead").Required().PlaceHolder("DEVICE").String(),
+		mountPoint:           f.Flag("mount-point", "Directory where the volume will be mounted").Required().PlaceHolder("DIR").String(),
+		fsck:                 f.Flag("fsck", "Check the file system of existing volumes before mounting: "+strings.Join(fsckPolicies, ", ")).Default(fsckSkip).PlaceHolder("POLICY").Enum(fsckPolicies...),
+		mountOptions:         f.Flag("mount-options", "Comma separated options to mount the volume with, e.g. noatime,discard").PlaceHolder("OPTIONS").String(),
+		readOnly:             f.Flag("read-only", "Mount the volume read-only").Bool(),
+		mountOwner:           f.Flag("mount-owner", "User owning the root of new file systems").PlaceHolder("USER").String(),
+		mountGroup:           f.Flag("mount-group", "Group owning the root of new file systems").PlaceHolder("GROUP").String(),
+		mountMode:            f.Flag("mount-mode", "Octal permissions of the root of new file systems, e.g. 0750").PlaceHolder("MODE").String(),
+		enforceOwnership:     f.Flag("enforce-mount-ownership", "Apply --mount-owner, --mount-group and --mount-mode on every mount, not only to new file systems").Bool(),
+		persistMount:         f.Flag("persist-mount", "Keep the volume mounted across reboots with an /etc/fstab entry or a systemd mount unit: "+strings.Join(persistModes, ", ")).Default(persistNone).PlaceHolder("HOW").Enum(persistModes...),
+		createSize:           f.Flag("create-size", "The size of the created volume, in GiBs. Smaller existing volumes are grown to this size").Required().PlaceHolder("SIZE").Int64(),
+		mkfsInodeRatio:       f.Flag("mkfs-inode-ratio", "mkfs.ext4 inode ratio (-i)").Default("16384").Int64(),
+		fileSystem:           f.Flag("filesystem", "The file system to create on new volumes: "+strings.Join(fileSystemNames(), ", ")).Default("ext4").PlaceHolder("TYPE").Enum(fileSystemNames()...),
+		fileSystemLabel:      f.Flag("filesystem-label", "Label of the created file system").PlaceHolder("LABEL").String(),
+		mkfsOptions:          f.Flag("mkfs-options", "Additional options passed to mkfs").PlaceHolder("OPTIONS").String(),
+		growFileSystem:       f.Flag("grow-filesystem", "Grow the file system to the size of its volume after restoring it from a snapshot or growing the volume").Default("true").Bool(),
+		createName:           f.Flag("create-name", "The name of the created volume").Required().PlaceHolder("NAME").String(),
+		createVolumeType:     f.Flag("create-volume-type", "The volume type of the created volume. This can be `gp2` or `gp3` for General Purpose (SSD), `io1` or `io2` for Provisioned IOPS (SSD), `st1` for Throughput Optimized (HDD), `sc1` for Cold (HDD) or `standard` for Magnetic volumes").Required().PlaceHolder("TYPE").Enum(volumeTypeNames()...),
+		iops:                 f.Flag("iops", "The provisioned IOPS of the created volume, for gp3, io1 and io2 volumes").Default("0").Int64(),
+		throughput:           f.Flag("throughput", "The provisioned throughput of the created volume in MiB/s, for gp3 volumes").Default("0").Int64(),
+		createTags:           CreateTags(f.Flag("create-tags", "Tag to use for the new volume, can be specified multiple times").PlaceHolder("KEY=VALUE")),
+		deleteOnTermination:  f.Flag("delete-on-termination", "Delete volume when instance is terminated").Bool(),
+		deviceTimeout:        f.Flag("device-timeout", "How long to wait for the device of an attached volume to show up").Default("60s").PlaceHolder("DURATION").Duration(),
+		claimTtl:             f.Flag("claim-ttl", "How long a claim of a volume by another instance is respected before it is considered stale, 0 to attach without claiming. RAID and LVM member volumes are not claimed").Default("2m").PlaceHolder("DURATION").Duration(),
+		claimDelay:           f.Flag("claim-delay", "How long to wait for competing claims and volume creations before checking whether this instance won").Default("2s").PlaceHolder("DURATION").Duration(),
+		creationWindow:       f.Flag("creation-window", "Volumes created for the same tag pair within this time of each other are deduplicated, keeping the first one, 0 to create without deduplication").Default("0").PlaceHolder("DURATION").Duration(),
+		slots:                f.Flag("slots", "Give every instance the volume of one of this many slots, tagged with the slot index, so it keeps its identity").Default("0").Int(),
+		firstSlot:            f.Flag("first-slot", "Index of the first slot").Default("0").Int(),
+		slotFromTag:          f.Flag("slot-from-tag", "Take the slot from this tag of the instance instead of the lowest free one").PlaceHolder("KEY").String(),
+		slotFile:             f.Flag("slot-file", "File to write the slot of the attached volume to, e.g. for use as node id").PlaceHolder("FILE").String(),
+		encrypted:            f.Flag("encrypted", "Create encrypted volumes, copying unencrypted snapshots first, and refuse to attach unencrypted volumes").Bool(),
+		kmsKeyId:             f.Flag("kms-key-id", "KMS key to encrypt new volumes with, implies --encrypted").PlaceHolder("KEY").String(),
+		snapshotName:         f.Flag("snapshot-name", "Name of snapshot to use for new volume").String(),
+		migrateFromOtherAz:   f.Flag("migrate-from-other-az", "Migrate a volume from another availability zone via snapshot if none is found in this one").Bool(),
+		retireMigratedVolume: f.Flag("retire-migrated-volume", "Delete the source volume after migrating it from another availability zone").Bool(),
+		raidDevices:          f.Flag("raid-devices", "Combine this many volumes into a RAID0 array, attached from --attach-as upwards. --create-size is per volume").Default("0").Int(),
+		raidDevice:           f.Flag("raid-device", "md device name of the RAID0 array").Default("md0").PlaceHolder("DEVICE").String(),
+		lvmVolumeGroup:       f.Flag("lvm-volume-group", "Put the attached volumes into this LVM volume group instead of using them directly").PlaceHolder("VG").String(),
+		lvmVolumes:           f.Flag("lvm-volumes", "Number of volumes in the LVM volume group, attached from --attach-as upwards. Raising it adds volumes to an existing group. --create-size is per volume").Default("1").Int(),
+		lvmLogicalVolume:     f.Flag("lvm-logical-volume", "Name of the LVM logical volume to create and mount").Default("data").PlaceHolder("LV").String(),
+		luksName:             f.Flag("luks-name", "Encrypt new volumes with LUKS and open them as /dev/mapper/NAME").PlaceHolder("NAME").String(),
+		luksKeyFile:          f.Flag("luks-key-file", "File with the LUKS key").PlaceHolder("FILE").String(),
+		luksKeyCommand:       f.Flag("luks-key-command", "Shell command printing the LUKS key").PlaceHolder("COMMAND").String(),
+	}
 }
 
 func main() {
-	cfg := &Config{
-		tagKey:              kingpin.Flag("tag-key", "The tag key to search for").Required().PlaceHolder("KEY").String(),
-		tagValue:            kingpin.Flag("tag-value", "The tag value to search for").Required().PlaceHolder("VALUE").String(),
-		attachAs:            kingpin.Flag("attach-as", "device name e.g. xvdb").Required().PlaceHolder("DEVICE").String(),
-		mountPoint:          kingpin.Flag("mount-point", "Directory where the volume will be mounted").Required().PlaceHolder("DIR").String(),
-		createSize:          kingpin.Flag("create-size", "The size of the created volume, in GiBs").Required().PlaceHolder("SIZE").Int64(),
-		mkfsInodeRatio:      kingpin.Flag("mkfs-inode-ratio", "mkfs.ext4 inode ratio (-i)").Default("16384").Int64(),
-		createName:          kingpin.Flag("create-name", "The name of the created volume").Required().PlaceHolder("NAME").String(),
-		createVolumeType:    kingpin.Flag("create-volume-type", "The volume type of the created volume. This can be `gp2` for General Purpose (SSD) volumes or `standard` for Magnetic volumes").Required().PlaceHolder("TYPE").Enum("standard", "gp2"),
-		createTags:          CreateTags(kingpin.Flag("create-tags", "Tag to use for the new volume, can be specified multiple times").PlaceHolder("KEY=VALUE")),
-		deleteOnTermination: kingpin.Flag("delete-on-termination", "Delete volume when instance is terminated").Bool(),
-		snapshotName:        kingpin.Flag("snapshot-name", "Name of snapshot to use for new volume").String(),
-		maxRetries:          kingpin.Flag("max-retries", "Maximum number of retries for AWS requests").Default("20").Int(),
+	maxRetries := kingpin.Flag("max-retries", "Maximum number of retries for AWS requests").Default("20").Int()
+
+	attachCmd := kingpin.Command("attach", "Create, attach, format and mount an EBS volume").Default()
+	cfg := attachFlags(attachCmd)
+	cfg.maxRetries = maxRetries
+
+	attachVolumesCmd := kingpin.Command("attach-volumes", "Create, attach, format and mount several EBS volumes")
+	volumesFile := attachVolumesCmd.Flag("volumes-file", "File with the attach flags of one volume per line, quoted like in a shell").PlaceHolder("FILE").String()
+	volumeSpecs := attachVolumesCmd.Arg("volume", "The attach flags of one volume, e.g. \"--tag-key=Name --tag-value=data ...\"").Strings()
+
+	detachCmd := kingpin.Command("detach", "Unmount, detach and release an EBS volume or the volumes of a RAID array or LVM volume group")
+	detachCfg := &DetachConfig{
+		attachAs:   detachCmd.Flag("attach-as", "device name e.g. xvdb").Required().PlaceHolder("DEVICE").String(),
+		mountPoint: detachCmd.Flag("mount-point", "Directory where the volume is mounted").Required().PlaceHolder("DIR").String(),
+	}
+
+	snapshotCmd := kingpin.Command("snapshot", "Create a snapshot of an attached EBS volume")
+	snapshotCfg := &SnapshotConfig{
+		mountPoint:   snapshotCmd.Flag("mount-point", "Directory where the volume is mounted").PlaceHolder("DIR").String(),
+		tagKey:       snapshotCmd.Flag("tag-key", "The tag key of the attached volume").PlaceHolder("KEY").String(),
+		tagValue:     snapshotCmd.Flag("tag-value", "The tag value of the attached volume").PlaceHolder("VALUE").String(),
+		snapshotName: snapshotCmd.Flag("snapshot-name", "Name of the created snapshot").Required().PlaceHolder("NAME").String(),
+		createTags:   CreateTags(snapshotCmd.Flag("create-tags", "Tag to use for the new snapshot, can be specified multiple times").PlaceHolder("KEY=VALUE")),
+		wait:         snapshotCmd.Flag("wait", "Wait until the snapshot is completed").Bool(),
+	}
+
+	pruneCmd := kingpin.Command("prune-snapshots", "Delete snapshots which are not covered by the retention policy")
+	pruneCfg := &PruneConfig{
+		snapshotName: pruneCmd.Flag("snapshot-name", "Name of the snapshots to prune").Required().PlaceHolder("NAME").String(),
+		keepLast:     pruneCmd.Flag("keep-last", "Keep the last N snapshots").PlaceHolder("N").Int(),
+		keepDaily:    pruneCmd.Flag("keep-daily", "Keep the last snapshot of each of the last N days").PlaceHolder("N").Int(),
+		keepWeekly:   pruneCmd.Flag("keep-weekly", "Keep the last snapshot of each of the last N weeks").PlaceHolder("N").Int(),
+		keepMonthly:  pruneCmd.Flag("keep-monthly", "Keep the last snapshot of each of the last N months").PlaceHolder("N").Int(),
+		maxAge:       pruneCmd.Flag("max-age", "Delete snapshots older than this, even if kept by another rule (e.g. 2160h)").PlaceHolder("DURATION").Duration(),
+		dryRun:       pruneCmd.Flag("dry-run", "Only report which snapshots would be deleted").Bool(),
 	}
 
 	kingpin.UsageTemplate(kingpin.CompactUsageTemplate)
 	kingpin.CommandLine.Help = "Script to create, attach, format and mount an EBS Volume to an EC2 instance"
-	kingpin.Parse()
+	command := kingpin.Parse()
 
-	awsAsgEbs := NewAwsAsgEbs(*cfg.maxRetries)
+	if command == snapshotCmd.FullCommand() && *snapshotCfg.mountPoint == "" && (*snapshotCfg.tagKey == "" || *snapshotCfg.tagValue == "") {
+		kingpin.Fatalf("either --mount-point or --tag-key and --tag-value are required, try --help")
+	}
 
-	runAsgEbs(awsAsgEbs, *cfg)
+	awsAsgEbs := NewAwsAsgEbs(*maxRetries)
+
+	switch command {
+	case attachCmd.FullCommand():
+		if runAsgEbs(awsAsgEbs, *cfg) != nil {
+			os.Exit(1)
+		}
+	case attachVolumesCmd.FullCommand():
+		cfgs, err := parseVolumeSpecs(*volumesFile, *volumeSpecs, maxRetries)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Fatal("Failed to parse volumes")
+		}
+		if runAttachVolumes(awsAsgEbs, cfgs) != nil {
+			os.Exit(1)
+		}
+	case detachCmd.FullCommand():
+		runDetach(awsAsgEbs, *detachCfg)
+	case snapshotCmd.FullCommand():
+		runSnapshot(awsAsgEbs, *snapshotCfg)
+	case pruneCmd.FullCommand():
+		runPruneSnapshots(awsAsgEbs, *pruneCfg)
+	}
 
 }
@@ -4,15 +4,21 @@ import (
 	"errors"
 	"path/filepath"
 	"testing"
+	"time"
 
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
 	"github.com/stretchr/testify/mock"
 )
 
 const (
 	defaultVolumeId   = "vol-123456"
 	defaultSnapshotId = "snap-123456"
+	defaultInstanceId = "i-123456"
 )
 
+var defaultMkfsArgs = []string{"-i", "4096"}
+
 type FakeAsgEbs struct {
 	mock.Mock
 	OnFindVolume               *mock.Call
@@ -21,6 +27,14 @@ type FakeAsgEbs struct {
 	OnAttachVolume             *mock.Call
 	OnMakeFileSystem           *mock.Call
 	OnMountVolume              *mock.Call
+	// Devices maps volume ids to the device they show up as, instead of
+	// the device name they were attached as.
+	Devices map[string]string
+	// DeviceExists and Mounted make the precondition checks fail.
+	DeviceExists bool
+	Mounted      bool
+	// LuksDevices are detected as LUKS containers.
+	LuksDevices map[string]bool
 }
 
 func NewFakeAsgEbs(cfg *Config) *FakeAsgEbs {
@@ -50,8 +64,8 @@ func (fakeAsgEbs *FakeAsgEbs) findSnapshot(tagKey string, tagValue string) (*str
 	}
 }
 
-func (fakeAsgEbs *FakeAsgEbs) createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string) (*string, error) {
-	args := fakeAsgEbs.Called(createSize, createName, createVolumeType, createTags, snapshotId)
+func (fakeAsgEbs *FakeAsgEbs) createVolume(createSize int64, createName string, createVolumeType string, createTags map[string]string, snapshotId *string, options VolumeOptions) (*string, error) {
+	args := fakeAsgEbs.Called(createSize, createName, createVolumeType, createTags, snapshotId, options)
 	vol := args.Get(0)
 	switch v := vol.(type) {
 	case string:
@@ -71,24 +85,325 @@ func (fakeAsgEbs *FakeAsgEbs) attachVolume(volumeId string, attachAs string, del
 	return args.Error(0)
 }
 
-func (fakeAsgEbs *FakeAsgEbs) makeFileSystem(device string, mkfsInodeRatio int64, volumeId string) error {
-	args := fakeAsgEbs.Called(device, mkfsInodeRatio, volumeId)
+func (fakeAsgEbs *FakeAsgEbs) volumeDevice(volumeId string, attachAs string, timeout time.Duration) (string, error) {
+	if device, ok := fakeAsgEbs.Devices[volumeId]; ok {
+		return device, nil
+	}
+	return "/dev/" + attachAs, nil
+}
+
+func (fakeAsgEbs *FakeAsgEbs) makeFileSystem(device string, fileSystem string, mkfsArgs []string, volumeId string) error {
+	args := fakeAsgEbs.Called(device, fileSystem, mkfsArgs, volumeId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) mountVolume(device string, mountPoint string, fileSystem string, options string) error {
+	args := fakeAsgEbs.Called(device, mountPoint, fileSystem, options)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) detectFileSystem(device string) (string, error) {
+	args := fakeAsgEbs.Called(device)
+	return args.String(0), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) fileSystemUuid(device string) (string, error) {
+	args := fakeAsgEbs.Called(device)
+	return args.String(0), args.Error(1)
+}
+
+// expects tells whether the test set up calls of the method. Methods looking
+// up volumes attached to this instance find none without.
+func (fakeAsgEbs *FakeAsgEbs) expects(method string) bool {
+	for _, call := range fakeAsgEbs.ExpectedCalls {
+		if call.Method == method {
+			return true
+		}
+	}
+	return false
+}
+
+func (fakeAsgEbs *FakeAsgEbs) findAttachedVolume(attachAs string) (*string, error) {
+	if !fakeAsgEbs.expects("findAttachedVolume") {
+		return nil, nil
+	}
+	args := fakeAsgEbs.Called(attachAs)
+	vol := args.Get(0)
+	switch v := vol.(type) {
+	case string:
+		return &v, args.Error(1)
+	default:
+		return nil, args.Error(1)
+	}
+}
+
+func (fakeAsgEbs *FakeAsgEbs) unmountVolume(mountPoint string) error {
+	args := fakeAsgEbs.Called(mountPoint)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) detachVolume(volumeId string, attachAs string) error {
+	args := fakeAsgEbs.Called(volumeId, attachAs)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) tagVolume(volumeId string, tags map[string]string) error {
+	args := fakeAsgEbs.Called(volumeId, tags)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deviceStack(mountPoint string) (DeviceStack, error) {
+	args := fakeAsgEbs.Called(mountPoint)
+	return args.Get(0).(DeviceStack), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) closeDevice(device string) error {
+	args := fakeAsgEbs.Called(device)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) findDeviceVolume(device string) (*string, error) {
+	args := fakeAsgEbs.Called(device)
+	vol := args.Get(0)
+	switch v := vol.(type) {
+	case string:
+		return &v, args.Error(1)
+	default:
+		return nil, args.Error(1)
+	}
+}
+
+func (fakeAsgEbs *FakeAsgEbs) extendVolumeGroup(volumeGroup string, devices []string) error {
+	args := fakeAsgEbs.Called(volumeGroup, devices)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) resizePhysicalVolume(device string) error {
+	args := fakeAsgEbs.Called(device)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) extendLogicalVolume(volumeGroup string, logicalVolume string) error {
+	args := fakeAsgEbs.Called(volumeGroup, logicalVolume)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) untagVolume(volumeId string, keys []string) error {
+	args := fakeAsgEbs.Called(volumeId, keys)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) findInstanceVolume(tagKey string, tagValue string) (*string, error) {
+	args := fakeAsgEbs.Called(tagKey, tagValue)
+	vol := args.Get(0)
+	switch v := vol.(type) {
+	case string:
+		return &v, args.Error(1)
+	default:
+		return nil, args.Error(1)
+	}
+}
+
+func (fakeAsgEbs *FakeAsgEbs) createSnapshot(volumeId string, snapshotName string, createTags map[string]string) (*string, error) {
+	args := fakeAsgEbs.Called(volumeId, snapshotName, createTags)
+	snap := args.Get(0)
+	switch v := snap.(type) {
+	case string:
+		return &v, args.Error(1)
+	default:
+		return nil, args.Error(1)
+	}
+}
+
+func (fakeAsgEbs *FakeAsgEbs) waitUntilSnapshotCompleted(snapshotId string) error {
+	args := fakeAsgEbs.Called(snapshotId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) listSnapshots(tagKey string, tagValue string) ([]*ec2.Snapshot, error) {
+	args := fakeAsgEbs.Called(tagKey, tagValue)
+	return args.Get(0).([]*ec2.Snapshot), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deleteSnapshot(snapshotId string) error {
+	args := fakeAsgEbs.Called(snapshotId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) findVolumesInOtherAz(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	args := fakeAsgEbs.Called(tagKey, tagValue)
+	return args.Get(0).([]*ec2.Volume), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) volumeTags(volumeId string) (map[string]string, error) {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Get(0).(map[string]string), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deleteVolume(volumeId string) error {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Error(0)
+}
+
+// findVolumes only returns the available volumes, like the filter of the
+// real one. Volumes without state count as available.
+func (fakeAsgEbs *FakeAsgEbs) findVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	args := fakeAsgEbs.Called(tagKey, tagValue)
+	volumes := []*ec2.Volume{}
+	for _, volume := range args.Get(0).([]*ec2.Volume) {
+		if volume.State == nil || *volume.State == "available" {
+			volumes = append(volumes, volume)
+		}
+	}
+	return volumes, args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) findInstanceVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	if !fakeAsgEbs.expects("findInstanceVolumes") {
+		return []*ec2.Volume{}, nil
+	}
+	args := fakeAsgEbs.Called(tagKey, tagValue)
+	return args.Get(0).([]*ec2.Volume), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) createRaid(device string, arrayUuid string, members []string) error {
+	args := fakeAsgEbs.Called(device, arrayUuid, members)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) assembleRaid(device string, arrayUuid string, members []string) error {
+	args := fakeAsgEbs.Called(device, arrayUuid, members)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) createVolumeGroup(volumeGroup string, logicalVolume string, devices []string) error {
+	args := fakeAsgEbs.Called(volumeGroup, logicalVolume, devices)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) activateVolumeGroup(volumeGroup string) error {
+	args := fakeAsgEbs.Called(volumeGroup)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) luksFormat(device string, key []byte) error {
+	args := fakeAsgEbs.Called(device, key)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) luksResize(name string, key []byte) error {
+	args := fakeAsgEbs.Called(name, key)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) isLuks(device string) (bool, error) {
+	return fakeAsgEbs.LuksDevices[device], nil
+}
+
+func (fakeAsgEbs *FakeAsgEbs) persistLuks(device string, name string, keyFile string) error {
+	args := fakeAsgEbs.Called(device, name, keyFile)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) luksOpen(device string, name string, key []byte) error {
+	args := fakeAsgEbs.Called(device, name, key)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) describeVolume(volumeId string) (*ec2.Volume, error) {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Get(0).(*ec2.Volume), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) describeSnapshot(snapshotId string) (*ec2.Snapshot, error) {
+	args := fakeAsgEbs.Called(snapshotId)
+	return args.Get(0).(*ec2.Snapshot), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) copySnapshot(snapshotId string, options VolumeOptions) (*string, error) {
+	args := fakeAsgEbs.Called(snapshotId, options)
+	snap := args.Get(0)
+	switch v := snap.(type) {
+	case string:
+		return &v, args.Error(1)
+	default:
+		return nil, args.Error(1)
+	}
+}
+
+func (fakeAsgEbs *FakeAsgEbs) modifyVolumeSize(volumeId string, size int64) error {
+	args := fakeAsgEbs.Called(volumeId, size)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) waitUntilVolumeModified(volumeId string) error {
+	args := fakeAsgEbs.Called(volumeId)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) fileSystemSize(device string, mountPoint string, fileSystem string) (int64, error) {
+	args := fakeAsgEbs.Called(device, mountPoint, fileSystem)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) deviceSize(device string) (int64, error) {
+	args := fakeAsgEbs.Called(device)
+	return args.Get(0).(int64), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) growFileSystem(device string, mountPoint string, fileSystem string) error {
+	args := fakeAsgEbs.Called(device, mountPoint, fileSystem)
+	return args.Error(0)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) persistMount(device string, mountPoint string, fileSystem string, options string, mode string) error {
+	args := fakeAsgEbs.Called(device, mountPoint, fileSystem, options, mode)
 	return args.Error(0)
 }
 
-func (fakeAsgEbs *FakeAsgEbs) mountVolume(device string, mountPoint string) error {
-	args := fakeAsgEbs.Called(device, mountPoint)
+func (fakeAsgEbs *FakeAsgEbs) setMountPointOwnership(mountPoint string, owner string, group string, mode string) error {
+	args := fakeAsgEbs.Called(mountPoint, owner, group, mode)
 	return args.Error(0)
 }
 
+func (fakeAsgEbs *FakeAsgEbs) checkFileSystem(device string, fileSystem string, policy string) (string, error) {
+	args := fakeAsgEbs.Called(device, fileSystem, policy)
+	return args.String(0), args.Error(1)
+}
+
 func (fakeAsgEbs *FakeAsgEbs) checkDevice(device string) error {
+	if fakeAsgEbs.DeviceExists {
+		return errors.New("Device exists")
+	}
 	return nil
 }
 
 func (fakeAsgEbs *FakeAsgEbs) checkMountPoint(mountPoint string) error {
+	if fakeAsgEbs.Mounted {
+		return errors.New("Already mounted")
+	}
 	return nil
 }
 
+func (fakeAsgEbs *FakeAsgEbs) findCreatedVolumes(createdFor string) ([]*ec2.Volume, error) {
+	args := fakeAsgEbs.Called(createdFor)
+	return args.Get(0).([]*ec2.Volume), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) findSlotVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	args := fakeAsgEbs.Called(tagKey, tagValue)
+	return args.Get(0).([]*ec2.Volume), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) instanceTag(key string) (string, error) {
+	args := fakeAsgEbs.Called(key)
+	return args.String(0), args.Error(1)
+}
+
+func (fakeAsgEbs *FakeAsgEbs) instanceId() string {
+	return defaultInstanceId
+}
+
 func strPtr(str string) *string {
 	return &str
 }
@@ -105,20 +420,58 @@ func boolPtr(b bool) *bool {
 	return &b
 }
 
+func durationPtr(d time.Duration) *time.Duration {
+	return &d
+}
+
 func newConfig() *Config {
 	return &Config{
-		tagKey:              strPtr("Name"),
-		tagValue:            strPtr("my-name"),
-		attachAs:            strPtr("xvdc"),
-		mountPoint:          strPtr("/mnt"),
-		createSize:          int64Ptr(200),
-		mkfsInodeRatio:      int64Ptr(4096),
-		createName:          strPtr("my-name"),
-		createVolumeType:    strPtr("gp2"),
-		createTags:          &map[string]string{},
-		deleteOnTermination: boolPtr(true),
-		snapshotName:        strPtr(""),
-		maxRetries:          intPtr(1),
+		tagKey:               strPtr("Name"),
+		tagValue:             strPtr("my-name"),
+		attachAs:             strPtr("xvdc"),
+		mountPoint:           strPtr("/mnt"),
+		fsck:                 strPtr(fsckSkip),
+		mountOptions:         strPtr(""),
+		readOnly:             boolPtr(false),
+		mountOwner:           strPtr(""),
+		mountGroup:           strPtr(""),
+		mountMode:            strPtr(""),
+		enforceOwnership:     boolPtr(false),
+		persistMount:         strPtr(persistNone),
+		createSize:           int64Ptr(200),
+		mkfsInodeRatio:       int64Ptr(4096),
+		fileSystem:           strPtr("ext4"),
+		fileSystemLabel:      strPtr(""),
+		mkfsOptions:          strPtr(""),
+		growFileSystem:       boolPtr(true),
+		createName:           strPtr("my-name"),
+		createVolumeType:     strPtr("gp2"),
+		iops:                 int64Ptr(0),
+		throughput:           int64Ptr(0),
+		createTags:           &map[string]string{},
+		deleteOnTermination:  boolPtr(true),
+		deviceTimeout:        durationPtr(time.Second),
+		claimTtl:             durationPtr(0),
+		claimDelay:           durationPtr(0),
+		creationWindow:       durationPtr(0),
+		slots:                intPtr(0),
+		firstSlot:            intPtr(0),
+		slotFromTag:          strPtr(""),
+		slotFile:             strPtr(""),
+		encrypted:            boolPtr(false),
+		kmsKeyId:             strPtr(""),
+		snapshotName:         strPtr(""),
+		migrateFromOtherAz:   boolPtr(false),
+		retireMigratedVolume: boolPtr(false),
+		raidDevices:          intPtr(0),
+		raidDevice:           strPtr("md0"),
+		lvmVolumeGroup:       strPtr(""),
+		lvmVolumes:           intPtr(1),
+		lvmLogicalVolume:     strPtr("data"),
+		luksName:             strPtr(""),
+		luksKeyFile:          strPtr(""),
+		luksKeyCommand:       strPtr(""),
+		maxRetries:           intPtr(1),
 	}
 }
 
@@ -130,7 +483,7 @@ func TestCreateVolumeIfNotFound(t *testing.T) {
 		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil, nil)
 	fakeAsgEbs.
-		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
 		Return(defaultVolumeId, nil)
 	fakeAsgEbs.
 		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
@@ -139,20 +492,23 @@ func TestCreateVolumeIfNotFound(t *testing.T) {
 		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
 		Return(nil)
 	fakeAsgEbs.
-		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("int64"), mock.AnythingOfType("string")).
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil)
 	fakeAsgEbs.
-		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
 		Return(nil)
 
 	runAsgEbs(fakeAsgEbs, *cfg)
 
 	fakeAsgEbs.AssertCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
-	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil))
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil), VolumeOptions{})
 	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeAvailable", defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
-	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint, *cfg.fileSystem, "")
 }
 
 func TestNoVolumeCreationOnFoundVolume(t *testing.T) {
@@ -166,16 +522,25 @@ func TestNoVolumeCreationOnFoundVolume(t *testing.T) {
 		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
 		Return(nil)
 	fakeAsgEbs.
-		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		On("describeVolume", mock.AnythingOfType("string")).
+		Return(&ec2.Volume{Size: aws.Int64(200)}, nil)
+	fakeAsgEbs.
+		On("volumeTags", mock.AnythingOfType("string")).
+		Return(map[string]string{fileSystemTypeTag: "xfs"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
 		Return(nil)
 
 	runAsgEbs(fakeAsgEbs, *cfg)
 
 	fakeAsgEbs.AssertCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
-	fakeAsgEbs.AssertNotCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil))
+	fakeAsgEbs.AssertNotCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil), VolumeOptions{})
 	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
-	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint, "xfs", "")
 }
 
 func TestRetryIfVolumeCouldNotBeAttached(t *testing.T) {
@@ -198,15 +563,24 @@ func TestRetryIfVolumeCouldNotBeAttached(t *testing.T) {
 		On("attachVolume", anotherVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
 		Return(nil)
 	fakeAsgEbs.
-		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		On("describeVolume", mock.AnythingOfType("string")).
+		Return(&ec2.Volume{Size: aws.Int64(200)}, nil)
+	fakeAsgEbs.
+		On("volumeTags", mock.AnythingOfType("string")).
+		Return(map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
 		Return(nil)
 
 	runAsgEbs(fakeAsgEbs, *cfg)
 
 	fakeAsgEbs.AssertNumberOfCalls(t, "findVolume", 2)
 	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 2)
-	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
-	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint, "ext4", "")
 }
 
 func TestCreateVolumeFromSnapshot(t *testing.T) {
@@ -218,7 +592,7 @@ func TestCreateVolumeFromSnapshot(t *testing.T) {
 		On("findSnapshot", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(defaultSnapshotId, nil)
 	fakeAsgEbs.
-		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
 		Return(defaultVolumeId, nil)
 	fakeAsgEbs.
 		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
@@ -227,18 +601,33 @@ func TestCreateVolumeFromSnapshot(t *testing.T) {
 		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
 		Return(nil)
 	fakeAsgEbs.
-		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{}, nil)
+	fakeAsgEbs.
+		On("detectFileSystem", "/dev/xvdc").
+		Return("ext4", nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+	fakeAsgEbs.
+		On("fileSystemSize", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(int64(200<<30), nil)
+	fakeAsgEbs.
+		On("deviceSize", mock.AnythingOfType("string")).
+		Return(int64(200<<30), nil)
 
 	runAsgEbs(fakeAsgEbs, *cfg)
 
 	fakeAsgEbs.AssertCalled(t, "findSnapshot", "Name", *cfg.snapshotName)
 	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
-	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, strPtr(defaultSnapshotId))
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, strPtr(defaultSnapshotId), VolumeOptions{})
 	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeAvailable", defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
-	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint, "ext4", "")
 }
 
 func TestCreateVolumeWhenSnapshotNotFound(t *testing.T) {
@@ -250,7 +639,7 @@ func TestCreateVolumeWhenSnapshotNotFound(t *testing.T) {
 		On("findSnapshot", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
 		Return(nil, nil)
 	fakeAsgEbs.
-		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string")).
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
 		Return(defaultVolumeId, nil)
 	fakeAsgEbs.
 		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
@@ -259,19 +648,214 @@ func TestCreateVolumeWhenSnapshotNotFound(t *testing.T) {
 		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
 		Return(nil)
 	fakeAsgEbs.
-		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("int64"), mock.AnythingOfType("string")).
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
 		Return(nil)
 	fakeAsgEbs.
-		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
 		Return(nil)
 
 	runAsgEbs(fakeAsgEbs, *cfg)
 
 	fakeAsgEbs.AssertCalled(t, "findSnapshot", "Name", *cfg.snapshotName)
 	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
-	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil))
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil), VolumeOptions{})
 	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeAvailable", defaultVolumeId)
 	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
-	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.mkfsInodeRatio, defaultVolumeId)
-	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint, *cfg.fileSystem, "")
+}
+
+func TestMigrateVolumeFromOtherAz(t *testing.T) {
+	cfg := newConfig()
+	cfg.migrateFromOtherAz = boolPtr(true)
+	cfg.retireMigratedVolume = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	sourceVolumeId := "vol-654321"
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("findVolumesInOtherAz", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(volumeList(sourceVolumeId), nil)
+	fakeAsgEbs.
+		On("volumeTags", sourceVolumeId).
+		Return(map[string]string{"Name": "my-name", "filesystem": "true", "team": "my-team"}, nil)
+	fakeAsgEbs.
+		On("createSnapshot", sourceVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string")).
+		Return(defaultSnapshotId, nil)
+	fakeAsgEbs.
+		On("waitUntilSnapshotCompleted", defaultSnapshotId).
+		Return(nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("deleteSnapshot", defaultSnapshotId).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("deleteVolume", sourceVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{fileSystemTypeTag: "ext4", "team": "my-team"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+	fakeAsgEbs.
+		On("fileSystemSize", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(int64(200<<30), nil)
+	fakeAsgEbs.
+		On("deviceSize", mock.AnythingOfType("string")).
+		Return(int64(200<<30), nil)
+
+	runAsgEbs(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertCalled(t, "findVolumesInOtherAz", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertCalled(t, "createSnapshot", sourceVolumeId, migrationSnapshotName(sourceVolumeId), *cfg.createTags)
+	fakeAsgEbs.AssertCalled(t, "deleteSnapshot", defaultSnapshotId)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, map[string]string{"team": "my-team"}, strPtr(defaultSnapshotId), VolumeOptions{})
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "deleteVolume", sourceVolumeId)
+	fakeAsgEbs.AssertNotCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", filepath.Join("/dev", *cfg.attachAs), *cfg.mountPoint, "ext4", "")
+}
+
+func TestKeepMigratedVolumeIfMountFails(t *testing.T) {
+	cfg := newConfig()
+	cfg.migrateFromOtherAz = boolPtr(true)
+	cfg.retireMigratedVolume = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	sourceVolumeId := "vol-654321"
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("findVolumesInOtherAz", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(volumeList(sourceVolumeId), nil)
+	fakeAsgEbs.
+		On("volumeTags", sourceVolumeId).
+		Return(map[string]string{"Name": "my-name", "filesystem": "true"}, nil)
+	fakeAsgEbs.
+		On("createSnapshot", sourceVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string")).
+		Return(defaultSnapshotId, nil)
+	fakeAsgEbs.
+		On("waitUntilSnapshotCompleted", defaultSnapshotId).
+		Return(nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("deleteSnapshot", defaultSnapshotId).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(errors.New("wrong fs type"))
+
+	runAsgEbs(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertCalled(t, "deleteSnapshot", defaultSnapshotId)
+	fakeAsgEbs.AssertNumberOfCalls(t, "deleteVolume", 0)
+}
+
+func TestSkipMigrationOfVolumeClaimedByOtherInstance(t *testing.T) {
+	cfg := newClaimConfig()
+	cfg.migrateFromOtherAz = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	sourceVolumeId := "vol-654321"
+
+	fakeAsgEbs.
+		On("findVolumes", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{}, nil)
+	fakeAsgEbs.
+		On("findVolumesInOtherAz", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(volumeList(sourceVolumeId), nil)
+	fakeAsgEbs.
+		On("volumeTags", sourceVolumeId).
+		Return(map[string]string{claimedByTag: "i-654321", claimedAtTag: time.Now().UTC().Format(time.RFC3339Nano)}, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	runAsgEbs(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertNumberOfCalls(t, "createSnapshot", 0)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil), VolumeOptions{})
+}
+
+func TestNoMigrationWithoutVolumeInOtherAz(t *testing.T) {
+	cfg := newConfig()
+	cfg.migrateFromOtherAz = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("findVolumesInOtherAz", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{}, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	runAsgEbs(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertNumberOfCalls(t, "createSnapshot", 0)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, *cfg.createTags, (*string)(nil), VolumeOptions{})
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", filepath.Join("/dev", *cfg.attachAs), *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
 }
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+func (awsAsgEbs *AwsAsgEbs) findVolumesInOtherAz(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	params := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("tag:" + tagKey),
+				Values: []*string{
+					aws.String(tagValue),
+				},
+			},
+			{
+				Name: aws.String("tag:filesystem"),
+				Values: []*string{
+					aws.String("true"),
+				},
+			},
+			{
+				Name: aws.String("status"),
+				Values: []*string{
+					aws.String("available"),
+				},
+			},
+		},
+	}
+
+	describeVolumesOutput, err := svc.DescribeVolumes(params)
+	if err != nil {
+		return nil, err
+	}
+	volumes := []*ec2.Volume{}
+	for _, volume := range describeVolumesOutput.Volumes {
+		if *volume.AvailabilityZone != awsAsgEbs.AvailabilityZone {
+			volumes = append(volumes, volume)
+		}
+	}
+	return volumes, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) volumeTags(volumeId string) (map[string]string, error) {
+	volume, err := awsAsgEbs.describeVolume(volumeId)
+	if err != nil {
+		return nil, err
+	}
+	tags := map[string]string{}
+	for _, tag := range volume.Tags {
+		tags[*tag.Key] = *tag.Value
+	}
+	return tags, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) deleteVolume(volumeId string) error {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	_, err := svc.DeleteVolume(&ec2.DeleteVolumeInput{
+		VolumeId: aws.String(volumeId),
+	})
+	return err
+}
+
+// migratedTags returns the tags of a migrated volume which have to be carried
+// over to its replacement. Name and filesystem are set by createVolume.
+func migratedTags(sourceTags map[string]string, createTags map[string]string) map[string]string {
+	tags := map[string]string{}
+	for k, v := range dataTags(sourceTags) {
+		if k == "Name" || k == "filesystem" {
+			continue
+		}
+		tags[k] = v
+	}
+	for k, v := range createTags {
+		tags[k] = v
+	}
+	return tags
+}
+
+// migrationSnapshotName names the snapshot a volume is migrated with. It is
+// deleted once the new volume is available.
+func migrationSnapshotName(sourceVolumeId string) string {
+	return fmt.Sprintf("Migration of %s", sourceVolumeId)
+}
+
+// snapshotVolumeFromOtherAz snapshots a matching volume from another
+// availability zone, so that it can be restored in the local one. The source
+// volume is claimed first, so that only one instance migrates it. It returns
+// the source volume, the snapshot and the tags for the new volume.
+func snapshotVolumeFromOtherAz(asgEbs AsgEbs, cfg Config) (*string, *string, map[string]string, error) {
+	volumes, err := asgEbs.findVolumesInOtherAz(*cfg.tagKey, *cfg.tagValue)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to find volume in other availability zone")
+		return nil, nil, nil, err
+	}
+	sourceVolumeId, err := newVolumeClaimer(asgEbs, cfg).claimVolume(volumes)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to claim volume in other availability zone")
+		return nil, nil, nil, err
+	}
+	if sourceVolumeId == nil {
+		return nil, nil, *cfg.createTags, nil
+	}
+
+	sourceTags, err := asgEbs.volumeTags(*sourceVolumeId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": *sourceVolumeId}).Error("Failed to read tags of volume")
+		return nil, nil, nil, err
+	}
+
+	log.WithFields(log.Fields{"volume": *sourceVolumeId}).Info("Snapshotting volume from other availability zone")
+	snapshotId, err := asgEbs.createSnapshot(*sourceVolumeId, migrationSnapshotName(*sourceVolumeId), *cfg.createTags)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": *sourceVolumeId}).Error("Failed to create snapshot")
+		return nil, nil, nil, err
+	}
+	log.WithFields(log.Fields{"snapshot": *snapshotId}).Info("Waiting until snapshot is completed")
+	err = asgEbs.waitUntilSnapshotCompleted(*snapshotId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "snapshot": *snapshotId}).Error("Waiting for snapshot timed out")
+		return nil, nil, nil, err
+	}
+
+	return sourceVolumeId, snapshotId, migratedTags(sourceTags, *cfg.createTags), nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const mountOptionsTag = "mount-options"
+
+// mountOptions returns the options to mount volumes with, as passed to
+// mount -o.
+func mountOptions(cfg Config) string {
+	options := []string{}
+	readOnly := false
+	for _, option := range strings.Split(*cfg.mountOptions, ",") {
+		option = strings.TrimSpace(option)
+		if option == "" {
+			continue
+		}
+		if option == "ro" {
+			readOnly = true
+		}
+		options = append(options, option)
+	}
+	if *cfg.readOnly && !readOnly {
+		options = append(options, "ro")
+	}
+	return strings.Join(options, ",")
+}
+
+func readOnlyMount(cfg Config) bool {
+	for _, option := range strings.Split(mountOptions(cfg), ",") {
+		if option == "ro" {
+			return true
+		}
+	}
+	return false
+}
+
+func (awsAsgEbs *AwsAsgEbs) detectFileSystem(device string) (string, error) {
+	out, err := output("/sbin/blkid", "-o", "value", "-s", "TYPE", device)
+	if err != nil {
+		return "", err
+	}
+	fileSystem := strings.TrimSpace(out)
+	if fileSystem == "" {
+		return "", fmt.Errorf("no file system found on %s", device)
+	}
+	return fileSystem, nil
+}
+
+// mountFileSystem mounts the device with the configured options and records
+// them on the volumes.
+func mountFileSystem(asgEbs AsgEbs, cfg Config, device string, fileSystem string, volumeIds []string) error {
+	options := mountOptions(cfg)
+	log.WithFields(log.Fields{"device": device, "mount_point": *cfg.mountPoint, "filesystem": fileSystem, "options": options}).Info("Mounting volume")
+	err := asgEbs.mountVolume(device, *cfg.mountPoint, fileSystem, options)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to mount volume")
+		return err
+	}
+
+	if options == "" {
+		options = "defaults"
+	}
+	for _, volumeId := range volumeIds {
+		err = asgEbs.tagVolume(volumeId, map[string]string{mountOptionsTag: options})
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": volumeId}).Warn("Failed to tag volume with mount options")
+		}
+	}
+	return nil
+}
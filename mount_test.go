@@ -0,0 +1,73 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestMountOptions(t *testing.T) {
+	cfg := newConfig()
+	assert.Equal(t, "", mountOptions(*cfg))
+
+	cfg.mountOptions = strPtr(" noatime, discard,,")
+	assert.Equal(t, "noatime,discard", mountOptions(*cfg))
+
+	cfg.readOnly = boolPtr(true)
+	assert.Equal(t, "noatime,discard,ro", mountOptions(*cfg))
+
+	cfg.mountOptions = strPtr("ro,noatime")
+	assert.Equal(t, "ro,noatime", mountOptions(*cfg))
+}
+
+func TestMountWithOptions(t *testing.T) {
+	cfg := newConfig()
+	cfg.mountOptions = strPtr("noatime,nobarrier")
+	cfg.readOnly = boolPtr(true)
+	fakeAsgEbs := newReattachFake(200)
+
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, map[string]string{mountOptionsTag: "noatime,nobarrier,ro"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "noatime,nobarrier,ro")
+	fakeAsgEbs.AssertCalled(t, "tagVolume", defaultVolumeId, map[string]string{mountOptionsTag: "noatime,nobarrier,ro"})
+}
+
+func TestDetectUnknownFileSystem(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("describeVolume", defaultVolumeId).
+		Return(&ec2.Volume{Size: aws.Int64(200)}, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{}, nil)
+	fakeAsgEbs.
+		On("detectFileSystem", "/dev/xvdc").
+		Return("btrfs", nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "btrfs", "")
+}
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+var mountInfoFile = "/proc/self/mountinfo"
+
+// MountEntry is a mounted file system from the mount table.
+type MountEntry struct {
+	Device     string
+	MountPoint string
+	FileSystem string
+	Options    string
+}
+
+// unescapeMountField decodes the octal escapes the kernel uses for spaces,
+// tabs, newlines and backslashes in paths, like \040 for a space.
+func unescapeMountField(field string) string {
+	if !strings.Contains(field, `\`) {
+		return field
+	}
+	unescaped := make([]byte, 0, len(field))
+	for i := 0; i < len(field); i++ {
+		if field[i] == '\\' && i+4 <= len(field) {
+			if c, err := strconv.ParseUint(field[i+1:i+4], 8, 8); err == nil {
+				unescaped = append(unescaped, byte(c))
+				i += 3
+				continue
+			}
+		}
+		unescaped = append(unescaped, field[i])
+	}
+	return string(unescaped)
+}
+
+// parseMountInfo parses the format of /proc/self/mountinfo, which has a
+// variable number of optional fields ended by a single dash:
+//
+//	36 35 98:0 /mnt1 /mnt2 rw,noatime master:1 - ext3 /dev/root rw,errors=continue
+func parseMountInfo(content string) ([]MountEntry, error) {
+	entries := []MountEntry{}
+	for _, line := range strings.Split(content, "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		fields := strings.Split(line, " ")
+		separator := -1
+		for i := 6; i < len(fields); i++ {
+			if fields[i] == "-" {
+				separator = i
+				break
+			}
+		}
+		if separator == -1 || len(fields) < separator+3 {
+			return nil, fmt.Errorf("invalid mountinfo line %q", line)
+		}
+		entries = append(entries, MountEntry{
+			Device:     unescapeMountField(fields[separator+2]),
+			MountPoint: unescapeMountField(fields[4]),
+			FileSystem: fields[separator+1],
+			Options:    fields[5],
+		})
+	}
+	return entries, nil
+}
+
+func readMountInfo() ([]MountEntry, error) {
+	content, err := ioutil.ReadFile(mountInfoFile)
+	if err != nil {
+		return nil, err
+	}
+	return parseMountInfo(string(content))
+}
+
+// findMountEntry returns the file system visible at the mount point. If
+// several are mounted on top of each other, the last one is visible.
+func findMountEntry(entries []MountEntry, mountPoint string) (MountEntry, bool) {
+	mountPoint = filepath.Clean(mountPoint)
+	var found MountEntry
+	ok := false
+	for _, entry := range entries {
+		if entry.MountPoint == mountPoint {
+			found = entry
+			ok = true
+		}
+	}
+	return found, ok
+}
+
+func mountEntry(mountPoint string) (MountEntry, error) {
+	entries, err := readMountInfo()
+	if err != nil {
+		return MountEntry{}, err
+	}
+	entry, ok := findMountEntry(entries, mountPoint)
+	if !ok {
+		return MountEntry{}, fmt.Errorf("mount point %s is not mounted", mountPoint)
+	}
+	return entry, nil
+}
+
+func isMounted(mountPoint string) (bool, error) {
+	entries, err := readMountInfo()
+	if err != nil {
+		return false, err
+	}
+	_, ok := findMountEntry(entries, mountPoint)
+	return ok, nil
+}
+
+func mountedDevice(mountPoint string) (string, error) {
+	entry, err := mountEntry(mountPoint)
+	if err != nil {
+		return "", err
+	}
+	return entry.Device, nil
+}
+
+func mountedFileSystemType(mountPoint string) (string, error) {
+	entry, err := mountEntry(mountPoint)
+	if err != nil {
+		return "", err
+	}
+	return entry.FileSystem, nil
+}
@@ -0,0 +1,75 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+const testMountInfo = `22 1 259:1 / / rw,relatime shared:1 - ext4 /dev/nvme0n1p1 rw,discard
+35 22 259:3 / /data2 rw,relatime shared:17 - xfs /dev/nvme1n1 rw,attr2,inode64
+36 22 259:4 / /var/lib/data rw,noatime - ext4 /dev/nvme2n1 rw
+37 22 202:32 / /mnt/my\040data rw,relatime shared:18 master:2 - ext4 /dev/xvdc rw
+38 22 202:48 / /srv ro,relatime - ext4 /dev/xvdd ro
+39 22 202:64 / /srv rw,relatime - xfs /dev/xvde rw
+`
+
+func TestParseMountInfo(t *testing.T) {
+	entries, err := parseMountInfo(testMountInfo)
+	assert.NoError(t, err)
+	assert.Len(t, entries, 6)
+	assert.Equal(t, MountEntry{Device: "/dev/nvme1n1", MountPoint: "/data2", FileSystem: "xfs", Options: "rw,relatime"}, entries[1])
+	assert.Equal(t, MountEntry{Device: "/dev/xvdc", MountPoint: "/mnt/my data", FileSystem: "ext4", Options: "rw,relatime"}, entries[3])
+
+	_, err = parseMountInfo("22 1 259:1 / / rw,relatime shared:1\n")
+	assert.Error(t, err)
+}
+
+func TestUnescapeMountField(t *testing.T) {
+	assert.Equal(t, "/mnt/a b\tc\\d", unescapeMountField(`/mnt/a\040b\011c\134d`))
+	assert.Equal(t, `/mnt/a\x`, unescapeMountField(`/mnt/a\x`))
+	assert.Equal(t, `/mnt/a\04`, unescapeMountField(`/mnt/a\04`))
+}
+
+func TestFindMountEntry(t *testing.T) {
+	entries, err := parseMountInfo(testMountInfo)
+	assert.NoError(t, err)
+
+	_, ok := findMountEntry(entries, "/data")
+	assert.False(t, ok)
+
+	entry, ok := findMountEntry(entries, "/data2/")
+	assert.True(t, ok)
+	assert.Equal(t, "/dev/nvme1n1", entry.Device)
+
+	entry, ok = findMountEntry(entries, "/mnt/my data")
+	assert.True(t, ok)
+	assert.Equal(t, "/dev/xvdc", entry.Device)
+
+	entry, ok = findMountEntry(entries, "/srv")
+	assert.True(t, ok)
+	assert.Equal(t, "/dev/xvde", entry.Device)
+}
+
+func TestCheckMountPoint(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mountinfo")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	defer func(file string) { mountInfoFile = file }(mountInfoFile)
+	mountInfoFile = filepath.Join(dir, "mountinfo")
+	assert.NoError(t, ioutil.WriteFile(mountInfoFile, []byte(testMountInfo), 0644))
+
+	awsAsgEbs := &AwsAsgEbs{}
+	assert.NoError(t, awsAsgEbs.checkMountPoint("/data"))
+	assert.Error(t, awsAsgEbs.checkMountPoint("/data2"))
+
+	fileSystem, err := mountedFileSystemType("/var/lib/data")
+	assert.NoError(t, err)
+	assert.Equal(t, "ext4", fileSystem)
+
+	_, err = mountedDevice("/data")
+	assert.Error(t, err)
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// Nitro instances expose EBS volumes as NVMe namespaces, whatever device name
+// they were attached as. The controller serial is the volume id without its
+// dash, which udev also uses for the /dev/disk/by-id links.
+const nvmeEbsModelPrefix = "nvme-Amazon_Elastic_Block_Store_"
+
+var (
+	devDir          = "/dev"
+	sysClassNvmeDir = "/sys/class/nvme"
+	sysBlockDir     = "/sys/block"
+)
+
+func nvmeSerial(volumeId string) string {
+	return strings.Replace(volumeId, "-", "", 1)
+}
+
+// nvmeVolumeId turns an NVMe controller serial back into a volume id.
+func nvmeVolumeId(serial string) (string, bool) {
+	serial = strings.TrimSpace(serial)
+	if !strings.HasPrefix(serial, "vol") || len(serial) <= 3 {
+		return "", false
+	}
+	return "vol-" + strings.TrimPrefix(strings.TrimPrefix(serial, "vol"), "-"), true
+}
+
+// nvmeSerialDevice finds the namespace of the NVMe controller with the serial
+// of the volume, for systems without the udev rules for EBS.
+func nvmeSerialDevice(volumeId string) (string, bool) {
+	controllers, err := ioutil.ReadDir(sysClassNvmeDir)
+	if err != nil {
+		return "", false
+	}
+	for _, controller := range controllers {
+		serial, err := ioutil.ReadFile(filepath.Join(sysClassNvmeDir, controller.Name(), "serial"))
+		if err != nil {
+			continue
+		}
+		if id, ok := nvmeVolumeId(string(serial)); !ok || id != volumeId {
+			continue
+		}
+		device := filepath.Join(devDir, controller.Name()+"n1")
+		if _, err := os.Stat(device); err == nil {
+			return device, true
+		}
+	}
+	return "", false
+}
+
+func nvmeVolumeLink(volumeId string) string {
+	return filepath.Join(devDir, "disk", "by-id", nvmeEbsModelPrefix+nvmeSerial(volumeId))
+}
+
+// findVolumeDevice returns the block device of an attached volume. It checks
+// the udev link and the controller serial for NVMe devices and falls back to
+// the device name the volume was attached as.
+func findVolumeDevice(volumeId string, attachAs string) (string, bool) {
+	if device, err := filepath.EvalSymlinks(nvmeVolumeLink(volumeId)); err == nil {
+		return device, true
+	}
+	if device, ok := nvmeSerialDevice(volumeId); ok {
+		return device, true
+	}
+	device := filepath.Join(devDir, attachAs)
+	if _, err := os.Stat(device); err == nil {
+		return device, true
+	}
+	return "", false
+}
+
+// volumeDevicePaths lists what findVolumeDevice checks, for error messages.
+func volumeDevicePaths(volumeId string, attachAs string) []string {
+	return []string{
+		nvmeVolumeLink(volumeId),
+		filepath.Join(sysClassNvmeDir, "*", "serial"),
+		filepath.Join(devDir, attachAs),
+	}
+}
+
+// deviceVolumeId returns the id of the EBS volume behind an NVMe device.
+func deviceVolumeId(device string) (string, bool) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return "", false
+	}
+	name := filepath.Base(resolved)
+	if !strings.HasPrefix(name, "nvme") {
+		return "", false
+	}
+	serial, err := ioutil.ReadFile(filepath.Join(sysBlockDir, name, "device", "serial"))
+	if err != nil {
+		return "", false
+	}
+	return nvmeVolumeId(string(serial))
+}
+
+func (awsAsgEbs *AwsAsgEbs) volumeDevice(volumeId string, attachAs string, timeout time.Duration) (string, error) {
+	var device string
+	found := waitFor(func() bool {
+		var ok bool
+		device, ok = findVolumeDevice(volumeId, attachAs)
+		return ok
+	}, []string{devDir, filepath.Join(devDir, "disk", "by-id")}, timeout)
+	if !found {
+		return "", fmt.Errorf("no device found for volume %s within %s, checked %s", volumeId, timeout, strings.Join(volumeDevicePaths(volumeId, attachAs), ", "))
+	}
+	return device, nil
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// withFakeDevices points the device lookups at a temporary directory tree.
+func withFakeDevices(t *testing.T) (string, func()) {
+	root, err := ioutil.TempDir("", "devices")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, dir := range []string{"dev/disk/by-id", "sys/class/nvme", "sys/block"} {
+		if err := os.MkdirAll(filepath.Join(root, dir), 0755); err != nil {
+			t.Fatal(err)
+		}
+	}
+	oldDevDir, oldSysClassNvmeDir, oldSysBlockDir := devDir, sysClassNvmeDir, sysBlockDir
+	devDir = filepath.Join(root, "dev")
+	sysClassNvmeDir = filepath.Join(root, "sys/class/nvme")
+	sysBlockDir = filepath.Join(root, "sys/block")
+	return root, func() {
+		devDir, sysClassNvmeDir, sysBlockDir = oldDevDir, oldSysClassNvmeDir, oldSysBlockDir
+		os.RemoveAll(root)
+	}
+}
+
+func writeFile(t *testing.T, path string, content string) {
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFindVolumeDeviceByIdLink(t *testing.T) {
+	root, cleanup := withFakeDevices(t)
+	defer cleanup()
+
+	writeFile(t, filepath.Join(root, "dev/nvme1n1"), "")
+	err := os.Symlink("../../nvme1n1", filepath.Join(root, "dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0"))
+	assert.NoError(t, err)
+
+	device, ok := findVolumeDevice("vol-0123456789abcdef0", "xvdc")
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(root, "dev/nvme1n1"), device)
+}
+
+func TestFindVolumeDeviceBySerial(t *testing.T) {
+	root, cleanup := withFakeDevices(t)
+	defer cleanup()
+
+	writeFile(t, filepath.Join(root, "sys/class/nvme/nvme0/serial"), "vol0aaaaaaaaaaaaaaaa \n")
+	writeFile(t, filepath.Join(root, "sys/class/nvme/nvme2/serial"), "vol0123456789abcdef0 \n")
+	writeFile(t, filepath.Join(root, "dev/nvme0n1"), "")
+	writeFile(t, filepath.Join(root, "dev/nvme2n1"), "")
+
+	device, ok := findVolumeDevice("vol-0123456789abcdef0", "xvdc")
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(root, "dev/nvme2n1"), device)
+}
+
+func TestFindVolumeDeviceFallsBackToAttachName(t *testing.T) {
+	root, cleanup := withFakeDevices(t)
+	defer cleanup()
+
+	_, ok := findVolumeDevice("vol-0123456789abcdef0", "xvdc")
+	assert.False(t, ok)
+
+	writeFile(t, filepath.Join(root, "dev/xvdc"), "")
+
+	device, ok := findVolumeDevice("vol-0123456789abcdef0", "xvdc")
+	assert.True(t, ok)
+	assert.Equal(t, filepath.Join(root, "dev/xvdc"), device)
+}
+
+func TestDeviceVolumeId(t *testing.T) {
+	root, cleanup := withFakeDevices(t)
+	defer cleanup()
+
+	writeFile(t, filepath.Join(root, "dev/nvme1n1"), "")
+	writeFile(t, filepath.Join(root, "dev/xvdc"), "")
+	writeFile(t, filepath.Join(root, "sys/block/nvme1n1/device/serial"), "vol0123456789abcdef0\n")
+
+	volumeId, ok := deviceVolumeId(filepath.Join(root, "dev/nvme1n1"))
+	assert.True(t, ok)
+	assert.Equal(t, "vol-0123456789abcdef0", volumeId)
+
+	_, ok = deviceVolumeId(filepath.Join(root, "dev/xvdc"))
+	assert.False(t, ok)
+}
+
+func TestUseResolvedNvmeDevice(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.Devices = map[string]string{defaultVolumeId: "/dev/nvme1n1"}
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, "xvdc", *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", "/dev/nvme1n1", *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/nvme1n1", *cfg.mountPoint, *cfg.fileSystem, "")
+}
@@ -0,0 +1,116 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"os/user"
+	"strconv"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// lookupId returns the numeric id of a user or group given by name or id, or
+// -1 to leave it unchanged.
+func lookupId(name string, lookup func(string) (string, error)) (int, error) {
+	if name == "" {
+		return -1, nil
+	}
+	if id, err := strconv.Atoi(name); err == nil {
+		return id, nil
+	}
+	id, err := lookup(name)
+	if err != nil {
+		return 0, err
+	}
+	return strconv.Atoi(id)
+}
+
+func parseMountMode(mode string) (os.FileMode, error) {
+	m, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil || m > 07777 {
+		return 0, fmt.Errorf("invalid mode %q, expected octal permissions like 0750", mode)
+	}
+	return os.FileMode(m&0777) | specialModeBits(m), nil
+}
+
+// specialModeBits converts setuid, setgid and sticky bits to os.FileMode.
+func specialModeBits(m uint64) os.FileMode {
+	var mode os.FileMode
+	if m&04000 != 0 {
+		mode |= os.ModeSetuid
+	}
+	if m&02000 != 0 {
+		mode |= os.ModeSetgid
+	}
+	if m&01000 != 0 {
+		mode |= os.ModeSticky
+	}
+	return mode
+}
+
+func validateMountOwnership(cfg Config) error {
+	if *cfg.mountMode == "" {
+		return nil
+	}
+	_, err := parseMountMode(*cfg.mountMode)
+	return err
+}
+
+func (awsAsgEbs *AwsAsgEbs) setMountPointOwnership(mountPoint string, owner string, group string, mode string) error {
+	uid, err := lookupId(owner, func(name string) (string, error) {
+		u, err := user.Lookup(name)
+		if err != nil {
+			return "", err
+		}
+		return u.Uid, nil
+	})
+	if err != nil {
+		return err
+	}
+	gid, err := lookupId(group, func(name string) (string, error) {
+		g, err := user.LookupGroup(name)
+		if err != nil {
+			return "", err
+		}
+		return g.Gid, nil
+	})
+	if err != nil {
+		return err
+	}
+	if uid != -1 || gid != -1 {
+		err = os.Chown(mountPoint, uid, gid)
+		if err != nil {
+			return err
+		}
+	}
+	if mode != "" {
+		m, err := parseMountMode(mode)
+		if err != nil {
+			return err
+		}
+		return os.Chmod(mountPoint, m)
+	}
+	return nil
+}
+
+// applyMountOwnership sets owner, group and mode of the root of freshly
+// created file systems, or of every mounted file system if enforced.
+func applyMountOwnership(asgEbs AsgEbs, cfg Config, fresh bool) error {
+	if *cfg.mountOwner == "" && *cfg.mountGroup == "" && *cfg.mountMode == "" {
+		return nil
+	}
+	if !fresh && !*cfg.enforceOwnership {
+		return nil
+	}
+	fields := log.Fields{"mount_point": *cfg.mountPoint, "owner": *cfg.mountOwner, "group": *cfg.mountGroup, "mode": *cfg.mountMode}
+	if readOnlyMount(cfg) {
+		log.WithFields(fields).Warn("Not changing ownership of read-only mount")
+		return nil
+	}
+	log.WithFields(fields).Info("Setting ownership of mount point")
+	err := asgEbs.setMountPointOwnership(*cfg.mountPoint, *cfg.mountOwner, *cfg.mountGroup, *cfg.mountMode)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "mount_point": *cfg.mountPoint}).Error("Failed to set ownership of mount point")
+	}
+	return err
+}
@@ -0,0 +1,126 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestLookupId(t *testing.T) {
+	lookup := func(name string) (string, error) {
+		if name == "postgres" {
+			return "26", nil
+		}
+		return "", errors.New("unknown user " + name)
+	}
+
+	id, err := lookupId("", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, -1, id)
+
+	id, err = lookupId("1000", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, 1000, id)
+
+	id, err = lookupId("postgres", lookup)
+	assert.NoError(t, err)
+	assert.Equal(t, 26, id)
+
+	_, err = lookupId("elasticsearch", lookup)
+	assert.Error(t, err)
+}
+
+func TestParseMountMode(t *testing.T) {
+	mode, err := parseMountMode("0750")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0750), mode)
+
+	mode, err = parseMountMode("1777")
+	assert.NoError(t, err)
+	assert.Equal(t, os.FileMode(0777)|os.ModeSticky, mode)
+
+	_, err = parseMountMode("rwxr-x---")
+	assert.Error(t, err)
+
+	_, err = parseMountMode("17777")
+	assert.Error(t, err)
+}
+
+func TestSetOwnershipOfNewFileSystem(t *testing.T) {
+	cfg := newConfig()
+	cfg.mountOwner = strPtr("postgres")
+	cfg.mountMode = strPtr("0700")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("setMountPointOwnership", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "setMountPointOwnership", *cfg.mountPoint, "postgres", "", "0700")
+}
+
+func TestKeepOwnershipOfReattachedFileSystem(t *testing.T) {
+	cfg := newConfig()
+	cfg.mountOwner = strPtr("postgres")
+	fakeAsgEbs := newReattachFake(200)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "setMountPointOwnership", 0)
+}
+
+func TestEnforceOwnershipOfReattachedFileSystem(t *testing.T) {
+	cfg := newConfig()
+	cfg.mountOwner = strPtr("postgres")
+	cfg.mountGroup = strPtr("postgres")
+	cfg.enforceOwnership = boolPtr(true)
+	fakeAsgEbs := newReattachFake(200)
+
+	fakeAsgEbs.
+		On("setMountPointOwnership", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "setMountPointOwnership", *cfg.mountPoint, "postgres", "postgres", "")
+}
+
+func TestRejectInvalidMountMode(t *testing.T) {
+	cfg := newConfig()
+	cfg.mountMode = strPtr("u=rwx")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "findVolume", 0)
+}
@@ -0,0 +1,190 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// Ways to make a mount survive a reboot of the instance.
+const (
+	persistNone    = "none"
+	persistFstab   = "fstab"
+	persistSystemd = "systemd"
+)
+
+var persistModes = []string{persistNone, persistFstab, persistSystemd}
+
+var (
+	fstabFile      = "/etc/fstab"
+	systemdUnitDir = "/etc/systemd/system"
+)
+
+// escapeFstabField escapes the characters fstab uses as separators.
+func escapeFstabField(field string) string {
+	return strings.NewReplacer(`\`, `\134`, " ", `\040`, "\t", `\011`, "\n", `\012`).Replace(field)
+}
+
+// persistedMountOptions adds nofail to the mount options, so instances still
+// boot if the volume is gone.
+func persistedMountOptions(options string) string {
+	if options == "" {
+		options = "defaults"
+	}
+	return options + ",nofail"
+}
+
+func fstabEntry(uuid string, mountPoint string, fileSystem string, options string) string {
+	if fileSystem == "" {
+		fileSystem = "auto"
+	}
+	return fmt.Sprintf("UUID=%s %s %s %s 0 2", uuid, escapeFstabField(mountPoint), fileSystem, escapeFstabField(persistedMountOptions(options)))
+}
+
+// updateFstab replaces the entries for the mount point with the given entry,
+// or appends it if there are none.
+func updateFstab(fstab string, mountPoint string, entry string) string {
+	return updateTable(fstab, 1, escapeFstabField(mountPoint), entry)
+}
+
+// updateTable replaces the lines of a table like fstab or crypttab whose
+// column matches the key with the given entry, or appends it if there are
+// none.
+func updateTable(table string, column int, key string, entry string) string {
+	lines := []string{}
+	if table != "" {
+		lines = strings.Split(strings.TrimRight(table, "\n"), "\n")
+	}
+	updated := []string{}
+	replaced := false
+	for _, line := range lines {
+		fields := strings.Fields(line)
+		if len(fields) > column && !strings.HasPrefix(fields[0], "#") && fields[column] == key {
+			if !replaced {
+				updated = append(updated, entry)
+				replaced = true
+			}
+			continue
+		}
+		updated = append(updated, line)
+	}
+	if !replaced {
+		updated = append(updated, entry)
+	}
+	return strings.Join(updated, "\n") + "\n"
+}
+
+// systemdEscapePath escapes a path for use in a unit name like
+// systemd-escape --path does.
+func systemdEscapePath(path string) string {
+	path = strings.Trim(path, "/")
+	if path == "" {
+		return "-"
+	}
+	escaped := ""
+	for i := 0; i < len(path); i++ {
+		c := path[i]
+		switch {
+		case c == '/':
+			escaped += "-"
+		case c == '.' && i == 0,
+			!(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == ':' || c == '_' || c == '.'):
+			escaped += fmt.Sprintf(`\x%02x`, c)
+		default:
+			escaped += string(c)
+		}
+	}
+	return escaped
+}
+
+func mountUnitName(mountPoint string) string {
+	return systemdEscapePath(mountPoint) + ".mount"
+}
+
+func mountUnit(uuid string, mountPoint string, fileSystem string, options string) string {
+	if fileSystem == "" {
+		fileSystem = "auto"
+	}
+	deviceUnit := systemdEscapePath("/dev/disk/by-uuid/"+uuid) + ".device"
+	return fmt.Sprintf(`[Unit]
+Description=EBS volume mounted at %s by asg-ebs
+Requires=%s
+After=%s
+Before=local-fs.target
+
+[Mount]
+What=/dev/disk/by-uuid/%s
+Where=%s
+Type=%s
+Options=%s
+
+[Install]
+WantedBy=local-fs.target
+`, mountPoint, deviceUnit, deviceUnit, uuid, mountPoint, fileSystem, persistedMountOptions(options))
+}
+
+// writeFileAtomically replaces the file so readers never see half of it.
+func writeFileAtomically(file string, content string) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(file), "."+filepath.Base(file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err = tmp.WriteString(content); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err = tmp.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), file)
+}
+
+func (awsAsgEbs *AwsAsgEbs) persistMount(device string, mountPoint string, fileSystem string, options string, mode string) error {
+	uuid, err := awsAsgEbs.fileSystemUuid(device)
+	if err != nil {
+		return err
+	}
+
+	switch mode {
+	case persistFstab:
+		fstab, err := ioutil.ReadFile(fstabFile)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+		return writeFileAtomically(fstabFile, updateFstab(string(fstab), mountPoint, fstabEntry(uuid, mountPoint, fileSystem, options)))
+	case persistSystemd:
+		unit := mountUnitName(mountPoint)
+		err = writeFileAtomically(filepath.Join(systemdUnitDir, unit), mountUnit(uuid, mountPoint, fileSystem, options))
+		if err != nil {
+			return err
+		}
+		err = run("/bin/systemctl", "daemon-reload")
+		if err != nil {
+			return err
+		}
+		return run("/bin/systemctl", "enable", unit)
+	}
+	return fmt.Errorf("unknown way to persist mounts %q", mode)
+}
+
+// persistVolumeMount makes the mount survive reboots if configured.
+func persistVolumeMount(asgEbs AsgEbs, cfg Config, device string, fileSystem string) error {
+	if *cfg.persistMount == persistNone {
+		return nil
+	}
+	log.WithFields(log.Fields{"device": device, "mount_point": *cfg.mountPoint, "persist": *cfg.persistMount}).Info("Persisting mount")
+	err := asgEbs.persistMount(device, *cfg.mountPoint, fileSystem, mountOptions(cfg), *cfg.persistMount)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "mount_point": *cfg.mountPoint}).Error("Failed to persist mount")
+	}
+	return err
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const fstab = `# /etc/fstab
+LABEL=cloudimg-rootfs	/	 ext4	defaults,discard	0 1
+# UUID=old /mnt ext4 defaults 0 2
+UUID=0f3e1a2b /mnt ext4 defaults,nofail 0 2
+`
+
+func TestUpdateFstab(t *testing.T) {
+	entry := fstabEntry("5c7d9e4f", "/mnt", "xfs", "")
+	assert.Equal(t, "UUID=5c7d9e4f /mnt xfs defaults,nofail 0 2", entry)
+
+	updated := updateFstab(fstab, "/mnt", entry)
+	assert.Equal(t, `# /etc/fstab
+LABEL=cloudimg-rootfs	/	 ext4	defaults,discard	0 1
+# UUID=old /mnt ext4 defaults 0 2
+UUID=5c7d9e4f /mnt xfs defaults,nofail 0 2
+`, updated)
+	assert.Equal(t, updated, updateFstab(updated, "/mnt", entry))
+
+	assert.Equal(t, "UUID=5c7d9e4f /mnt/my\\040data auto noatime,ro,nofail 0 2\n", updateFstab("", "/mnt/my data", fstabEntry("5c7d9e4f", "/mnt/my data", "", "noatime,ro")))
+}
+
+func TestMountUnitName(t *testing.T) {
+	assert.Equal(t, "mnt-data.mount", mountUnitName("/mnt/data"))
+	assert.Equal(t, `srv-my\x20data-web\x2d1.mount`, mountUnitName("/srv/my data/web-1/"))
+	assert.Equal(t, "-.mount", mountUnitName("/"))
+}
+
+func TestMountUnit(t *testing.T) {
+	unit := mountUnit("5c7d9e4f-aaaa", "/mnt/data", "ext4", "")
+
+	assert.Contains(t, unit, "Requires=dev-disk-by\\x2duuid-5c7d9e4f\\x2daaaa.device\n")
+	assert.Contains(t, unit, "After=dev-disk-by\\x2duuid-5c7d9e4f\\x2daaaa.device\n")
+	assert.Contains(t, unit, "What=/dev/disk/by-uuid/5c7d9e4f-aaaa\nWhere=/mnt/data\nType=ext4\nOptions=defaults,nofail\n")
+}
+
+func TestPersistMount(t *testing.T) {
+	cfg := newConfig()
+	cfg.persistMount = strPtr(persistFstab)
+	fakeAsgEbs := newReattachFake(200)
+
+	fakeAsgEbs.
+		On("persistMount", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "persistMount", "/dev/xvdc", *cfg.mountPoint, "xfs", "", persistFstab)
+}
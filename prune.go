@@ -0,0 +1,137 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+type RetentionPolicy struct {
+	KeepLast    int
+	KeepDaily   int
+	KeepWeekly  int
+	KeepMonthly int
+	MaxAge      time.Duration
+}
+
+func (p RetentionPolicy) hasKeepRules() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+// keepBuckets marks the newest snapshot of each of the first n distinct
+// buckets. Snapshots must be sorted newest first.
+func keepBuckets(snapshots []*ec2.Snapshot, keep map[int]bool, n int, bucket func(time.Time) string) {
+	seen := map[string]bool{}
+	for i, snapshot := range snapshots {
+		if len(seen) >= n {
+			return
+		}
+		b := bucket(snapshot.StartTime.UTC())
+		if !seen[b] {
+			seen[b] = true
+			keep[i] = true
+		}
+	}
+}
+
+// expiredSnapshots returns the snapshots which are not covered by the
+// retention policy. The newest snapshot, which findSnapshot would restore
+// from, is never returned.
+func expiredSnapshots(snapshots []*ec2.Snapshot, policy RetentionPolicy, now time.Time) []*ec2.Snapshot {
+	sorted := make([]*ec2.Snapshot, len(snapshots))
+	copy(sorted, snapshots)
+	sort.Sort(sort.Reverse(ByStartTime(sorted)))
+
+	keep := map[int]bool{}
+	if !policy.hasKeepRules() {
+		for i := range sorted {
+			keep[i] = true
+		}
+	}
+	for i := 0; i < policy.KeepLast && i < len(sorted); i++ {
+		keep[i] = true
+	}
+	keepBuckets(sorted, keep, policy.KeepDaily, func(t time.Time) string {
+		return t.Format("2006-01-02")
+	})
+	keepBuckets(sorted, keep, policy.KeepWeekly, func(t time.Time) string {
+		year, week := t.ISOWeek()
+		return fmt.Sprintf("%d-%d", year, week)
+	})
+	keepBuckets(sorted, keep, policy.KeepMonthly, func(t time.Time) string {
+		return t.Format("2006-01")
+	})
+	if policy.MaxAge > 0 {
+		for i, snapshot := range sorted {
+			if now.Sub(*snapshot.StartTime) > policy.MaxAge {
+				delete(keep, i)
+			}
+		}
+	}
+
+	expired := []*ec2.Snapshot{}
+	for i, snapshot := range sorted {
+		if i == 0 || keep[i] {
+			continue
+		}
+		expired = append(expired, snapshot)
+	}
+	return expired
+}
+
+func (awsAsgEbs *AwsAsgEbs) deleteSnapshot(snapshotId string) error {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	deleteSnapshotInput := &ec2.DeleteSnapshotInput{
+		SnapshotId: aws.String(snapshotId),
+	}
+	_, err := svc.DeleteSnapshot(deleteSnapshotInput)
+	return err
+}
+
+type PruneConfig struct {
+	snapshotName *string
+	keepLast     *int
+	keepDaily    *int
+	keepWeekly   *int
+	keepMonthly  *int
+	maxAge       *time.Duration
+	dryRun       *bool
+}
+
+func runPruneSnapshots(asgEbs AsgEbs, cfg PruneConfig) {
+	policy := RetentionPolicy{
+		KeepLast:    *cfg.keepLast,
+		KeepDaily:   *cfg.keepDaily,
+		KeepWeekly:  *cfg.keepWeekly,
+		KeepMonthly: *cfg.keepMonthly,
+		MaxAge:      *cfg.maxAge,
+	}
+
+	snapshots, err := asgEbs.listSnapshots("Name", *cfg.snapshotName)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "snapshot_name": *cfg.snapshotName}).Fatal("Failed to list snapshots")
+	}
+
+	expired := expiredSnapshots(snapshots, policy, time.Now())
+	log.WithFields(log.Fields{"snapshot_name": *cfg.snapshotName, "total": len(snapshots), "expired": len(expired)}).Info("Applied retention policy")
+
+	for _, snapshot := range expired {
+		fields := log.Fields{"snapshot": *snapshot.SnapshotId, "start_time": *snapshot.StartTime}
+		if *cfg.dryRun {
+			log.WithFields(fields).Info("Would delete snapshot")
+			continue
+		}
+		log.WithFields(fields).Info("Deleting snapshot")
+		err = asgEbs.deleteSnapshot(*snapshot.SnapshotId)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "snapshot": *snapshot.SnapshotId}).Fatal("Failed to delete snapshot")
+		}
+	}
+}
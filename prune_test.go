@@ -0,0 +1,121 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+var pruneNow = time.Date(2016, 3, 31, 12, 0, 0, 0, time.UTC)
+
+// dailySnapshots returns one snapshot per day for the last n days, oldest first.
+func dailySnapshots(n int) []*ec2.Snapshot {
+	snapshots := []*ec2.Snapshot{}
+	for i := n - 1; i >= 0; i-- {
+		snapshots = append(snapshots, &ec2.Snapshot{
+			SnapshotId: aws.String(fmt.Sprintf("snap-%d", i)),
+			StartTime:  aws.Time(pruneNow.AddDate(0, 0, -i)),
+		})
+	}
+	return snapshots
+}
+
+func snapshotIds(snapshots []*ec2.Snapshot) []string {
+	ids := []string{}
+	for _, snapshot := range snapshots {
+		ids = append(ids, *snapshot.SnapshotId)
+	}
+	return ids
+}
+
+func TestExpiredSnapshotsWithoutPolicy(t *testing.T) {
+	expired := expiredSnapshots(dailySnapshots(10), RetentionPolicy{}, pruneNow)
+
+	assert.Empty(t, expired)
+}
+
+func TestExpiredSnapshotsKeepLast(t *testing.T) {
+	expired := expiredSnapshots(dailySnapshots(5), RetentionPolicy{KeepLast: 3}, pruneNow)
+
+	assert.Equal(t, []string{"snap-3", "snap-4"}, snapshotIds(expired))
+}
+
+func TestExpiredSnapshotsKeepBuckets(t *testing.T) {
+	snapshots := dailySnapshots(60)
+	// A second snapshot on the newest day must not use up a daily bucket.
+	snapshots = append(snapshots, &ec2.Snapshot{
+		SnapshotId: aws.String("snap-latest"),
+		StartTime:  aws.Time(pruneNow.Add(time.Hour)),
+	})
+
+	expired := expiredSnapshots(snapshots, RetentionPolicy{KeepDaily: 2, KeepMonthly: 2}, pruneNow)
+	kept := map[string]bool{}
+	for _, snapshot := range snapshots {
+		kept[*snapshot.SnapshotId] = true
+	}
+	for _, snapshot := range expired {
+		delete(kept, *snapshot.SnapshotId)
+	}
+
+	// Last of today, yesterday, end of February.
+	assert.Equal(t, map[string]bool{"snap-latest": true, "snap-1": true, "snap-31": true}, kept)
+}
+
+func TestExpiredSnapshotsNeverExpiresNewest(t *testing.T) {
+	snapshots := dailySnapshots(5)
+
+	expired := expiredSnapshots(snapshots, RetentionPolicy{MaxAge: time.Hour}, pruneNow.Add(48*time.Hour))
+
+	assert.Equal(t, []string{"snap-1", "snap-2", "snap-3", "snap-4"}, snapshotIds(expired))
+}
+
+func TestPruneSnapshotsDryRun(t *testing.T) {
+	cfg := &PruneConfig{
+		snapshotName: strPtr("my-name"),
+		keepLast:     intPtr(1),
+		keepDaily:    intPtr(0),
+		keepWeekly:   intPtr(0),
+		keepMonthly:  intPtr(0),
+		maxAge:       new(time.Duration),
+		dryRun:       boolPtr(true),
+	}
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("listSnapshots", "Name", *cfg.snapshotName).
+		Return(dailySnapshots(3), nil)
+
+	runPruneSnapshots(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertNumberOfCalls(t, "deleteSnapshot", 0)
+}
+
+func TestPruneSnapshotsDeletesExpired(t *testing.T) {
+	cfg := &PruneConfig{
+		snapshotName: strPtr("my-name"),
+		keepLast:     intPtr(1),
+		keepDaily:    intPtr(0),
+		keepWeekly:   intPtr(0),
+		keepMonthly:  intPtr(0),
+		maxAge:       new(time.Duration),
+		dryRun:       boolPtr(false),
+	}
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("listSnapshots", "Name", *cfg.snapshotName).
+		Return(dailySnapshots(3), nil)
+	fakeAsgEbs.
+		On("deleteSnapshot", mock.AnythingOfType("string")).
+		Return(nil)
+
+	runPruneSnapshots(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertNumberOfCalls(t, "deleteSnapshot", 2)
+	fakeAsgEbs.AssertNotCalled(t, "deleteSnapshot", "snap-0")
+}
@@ -0,0 +1,327 @@
+package main
+
+import (
+	"crypto/rand"
+	"errors"
+	"fmt"
+	"strconv"
+
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	raidArrayTag  = "raid-array"
+	raidMemberTag = "raid-member"
+)
+
+// memberDevice returns the device name of the RAID member with the given
+// index, counting upwards from attachAs, e.g. xvdf, xvdg, xvdh.
+func memberDevice(attachAs string, index int) (string, error) {
+	if attachAs == "" {
+		return "", fmt.Errorf("empty device name")
+	}
+	last := attachAs[len(attachAs)-1]
+	if last < 'a' || last > 'z' || int(last)+index > 'z' {
+		return "", fmt.Errorf("cannot derive member %d from device %s", index, attachAs)
+	}
+	return attachAs[:len(attachAs)-1] + string(last+byte(index)), nil
+}
+
+// newArrayUuid returns a random UUID in the format used by mdadm.
+func newArrayUuid() (string, error) {
+	b := make([]byte, 16)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%x:%x:%x:%x", b[0:4], b[4:8], b[8:12], b[12:16]), nil
+}
+
+// validateRaid refuses options which only apply to a single volume, as the
+// members of an array are neither restored from snapshots nor migrated.
+func validateRaid(cfg Config) error {
+	if *cfg.raidDevices == 0 {
+		return nil
+	}
+	if *cfg.snapshotName != "" {
+		return errors.New("--raid-devices cannot be combined with --snapshot-name")
+	}
+	if *cfg.migrateFromOtherAz {
+		return errors.New("--raid-devices cannot be combined with --migrate-from-other-az")
+	}
+	return nil
+}
+
+// raidMembers picks the members of a RAID array from the given volumes. It
+// returns the array UUID and the member volume ids ordered by index, or no
+// members if none of the volumes belongs to an array. Only some members of an
+// array being available is an error, as creating a new array would hide the
+// data of the existing one.
+func raidMembers(volumes []*ec2.Volume, raidDevices int) (string, []string, error) {
+	arrays := map[string]map[int]string{}
+	for _, volume := range volumes {
+		tags := map[string]string{}
+		for _, tag := range volume.Tags {
+			tags[*tag.Key] = *tag.Value
+		}
+		arrayUuid, ok := tags[raidArrayTag]
+		if !ok {
+			continue
+		}
+		index, err := strconv.Atoi(tags[raidMemberTag])
+		if err != nil || index < 0 || index >= raidDevices {
+			return "", nil, fmt.Errorf("volume %s has invalid %s tag '%s'", *volume.VolumeId, raidMemberTag, tags[raidMemberTag])
+		}
+		if arrays[arrayUuid] == nil {
+			arrays[arrayUuid] = map[int]string{}
+		}
+		arrays[arrayUuid][index] = *volume.VolumeId
+	}
+
+	if len(arrays) == 0 {
+		return "", nil, nil
+	}
+	for arrayUuid, members := range arrays {
+		if len(members) != raidDevices {
+			continue
+		}
+		volumeIds := make([]string, raidDevices)
+		for index, volumeId := range members {
+			volumeIds[index] = volumeId
+		}
+		return arrayUuid, volumeIds, nil
+	}
+	for arrayUuid, members := range arrays {
+		return "", nil, fmt.Errorf("found only %d of %d members of array %s", len(members), raidDevices, arrayUuid)
+	}
+	return "", nil, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) createRaid(device string, arrayUuid string, members []string) error {
+	args := []string{"--create", device, "--run", "--level=0", fmt.Sprintf("--raid-devices=%d", len(members)), "--uuid=" + arrayUuid}
+	return run("/sbin/mdadm", append(args, members...)...)
+}
+
+func (awsAsgEbs *AwsAsgEbs) assembleRaid(device string, arrayUuid string, members []string) error {
+	args := []string{"--assemble", device, "--uuid=" + arrayUuid}
+	return run("/sbin/mdadm", append(args, members...)...)
+}
+
+// memberDevices returns the device names of count members, counting upwards
+// from attachAs.
+func memberDevices(attachAs string, count int) ([]string, error) {
+	devices := []string{}
+	for i := 0; i < count; i++ {
+		device, err := memberDevice(attachAs, i)
+		if err != nil {
+			return nil, err
+		}
+		devices = append(devices, device)
+	}
+	return devices, nil
+}
+
+// createMembers creates the member volumes with the indexes first up to last
+// of a RAID array or volume group, tagged with the group tags and their index,
+// and waits until they are available.
+func createMembers(asgEbs AsgEbs, cfg Config, groupTags map[string]string, memberTag string, first int, last int) ([]string, error) {
+	volumeIds := []string{}
+	for i := first; i < last; i++ {
+		createTags := map[string]string{memberTag: strconv.Itoa(i)}
+		for k, v := range groupTags {
+			createTags[k] = v
+		}
+		for k, v := range *cfg.createTags {
+			createTags[k] = v
+		}
+		volumeId, err := asgEbs.createVolume(*cfg.createSize, *cfg.createName, *cfg.createVolumeType, createTags, nil, volumeOptions(cfg))
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to create new volume")
+			return nil, err
+		}
+		volumeIds = append(volumeIds, *volumeId)
+	}
+	for _, volumeId := range volumeIds {
+		log.WithFields(log.Fields{"volume": volumeId}).Info("Waiting until new volume is available")
+		err := asgEbs.waitUntilVolumeAvailable(volumeId)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Waiting for volume timed out")
+			return nil, err
+		}
+	}
+	return volumeIds, nil
+}
+
+// findMembers returns the volumes which may be members, the available ones
+// and the ones still attached to this instance by an earlier run, e.g. before
+// a reboot. The latter are returned as attached too.
+func findMembers(asgEbs AsgEbs, cfg Config) ([]*ec2.Volume, map[string]bool, error) {
+	volumes, err := asgEbs.findVolumes(*cfg.tagKey, *cfg.tagValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	instanceVolumes, err := asgEbs.findInstanceVolumes(*cfg.tagKey, *cfg.tagValue)
+	if err != nil {
+		return nil, nil, err
+	}
+	attached := map[string]bool{}
+	for _, volume := range instanceVolumes {
+		attached[*volume.VolumeId] = true
+		volumes = append(volumes, volume)
+	}
+	return volumes, attached, nil
+}
+
+// attachMembers attaches the member volumes as the given devices and returns
+// their block devices. Members still attached by an earlier run are kept.
+func attachMembers(asgEbs AsgEbs, cfg Config, volumeIds []string, devices []string, attached map[string]bool) ([]string, error) {
+	blockDevices := []string{}
+	for i, volumeId := range volumeIds {
+		if attached[volumeId] {
+			log.WithFields(log.Fields{"volume": volumeId, "device": devices[i]}).Info("Member volume is already attached")
+		} else {
+			log.WithFields(log.Fields{"volume": volumeId, "device": devices[i]}).Info("Attaching member volume")
+			err := asgEbs.attachVolume(volumeId, devices[i], *cfg.deleteOnTermination)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err}).Error("Failed to attach volume")
+				return nil, err
+			}
+		}
+		blockDevice, err := asgEbs.volumeDevice(volumeId, devices[i], *cfg.deviceTimeout)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Attached volume did not show up")
+			return nil, err
+		}
+		blockDevices = append(blockDevices, blockDevice)
+	}
+	return blockDevices, nil
+}
+
+// mountMembers sets up LUKS and the file system on the device spanning the
+// member volumes and mounts it. The file system tags are read from the first
+// member. The file system is grown if the device was.
+func mountMembers(asgEbs AsgEbs, cfg Config, device string, volumeIds []string, create bool, grown bool) error {
+	device, err := setupLuks(asgEbs, cfg, device, volumeIds, create)
+	if err != nil {
+		return err
+	}
+
+	fileSystem := *cfg.fileSystem
+	if create {
+		log.WithFields(log.Fields{"device": device, "filesystem": fileSystem}).Info("Creating file system on new member volumes")
+		err = asgEbs.makeFileSystem(device, fileSystem, mkfsArgs(cfg), volumeIds[0])
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to create file system")
+			return err
+		}
+		for _, volumeId := range volumeIds[1:] {
+			err = asgEbs.tagVolume(volumeId, map[string]string{"filesystem": "true", fileSystemTypeTag: fileSystem})
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to tag volume")
+				return err
+			}
+		}
+	} else {
+		fileSystem, err = volumeFileSystem(asgEbs, volumeIds[0], device)
+		if err != nil {
+			return err
+		}
+		err = verifyFileSystemUuid(asgEbs, volumeIds[0], device)
+		if err != nil {
+			return err
+		}
+		err = checkVolumeFileSystem(asgEbs, cfg, device, fileSystem, volumeIds)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = mountFileSystem(asgEbs, cfg, device, fileSystem, volumeIds)
+	if err != nil {
+		return err
+	}
+
+	err = applyMountOwnership(asgEbs, cfg, create)
+	if err != nil {
+		return err
+	}
+
+	if *cfg.growFileSystem && grown {
+		err = growVolumeFileSystem(asgEbs, cfg, device, fileSystem)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "device": device}).Warn("Failed to grow file system")
+		}
+	}
+
+	return persistVolumeMount(asgEbs, cfg, device, fileSystem)
+}
+
+func runRaid(asgEbs AsgEbs, cfg Config) error {
+	raidDevices := *cfg.raidDevices
+	raidDevice := "/dev/" + *cfg.raidDevice
+
+	devices, err := memberDevices(*cfg.attachAs, raidDevices)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Invalid RAID member device")
+		return err
+	}
+
+	volumes, attached, err := findMembers(asgEbs, cfg)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to find volumes")
+		return err
+	}
+	arrayUuid, volumeIds, err := raidMembers(volumes, raidDevices)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Refusing to create RAID array")
+		return err
+	}
+
+	for _, volumeId := range volumeIds {
+		err = checkEncryption(asgEbs, cfg, volumeId)
+		if err != nil {
+			return err
+		}
+	}
+
+	createArray := volumeIds == nil
+	if createArray {
+		arrayUuid, err = newArrayUuid()
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to generate array UUID")
+			return err
+		}
+		log.WithFields(log.Fields{"array": arrayUuid, "members": raidDevices}).Info("Creating new RAID member volumes")
+		volumeIds, err = createMembers(asgEbs, cfg, map[string]string{raidArrayTag: arrayUuid}, raidMemberTag, 0, raidDevices)
+		if err != nil {
+			return err
+		}
+	}
+
+	blockDevices, err := attachMembers(asgEbs, cfg, volumeIds, devices, attached)
+	if err != nil {
+		return err
+	}
+
+	if createArray {
+		log.WithFields(log.Fields{"device": raidDevice, "array": arrayUuid}).Info("Creating RAID array")
+		err = asgEbs.createRaid(raidDevice, arrayUuid, blockDevices)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to create RAID array")
+			return err
+		}
+	} else if asgEbs.checkDevice(raidDevice) != nil {
+		log.WithFields(log.Fields{"device": raidDevice, "array": arrayUuid}).Info("RAID array is already assembled")
+	} else {
+		log.WithFields(log.Fields{"device": raidDevice, "array": arrayUuid}).Info("Assembling RAID array")
+		err = asgEbs.assembleRaid(raidDevice, arrayUuid, blockDevices)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err}).Error("Failed to assemble RAID array")
+			return err
+		}
+	}
+
+	return mountMembers(asgEbs, cfg, raidDevice, volumeIds, createArray, false)
+}
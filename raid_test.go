@@ -0,0 +1,180 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+const defaultArrayUuid = "01234567:89abcdef:01234567:89abcdef"
+
+func raidVolume(volumeId string, arrayUuid string, member int) *ec2.Volume {
+	return &ec2.Volume{
+		VolumeId: aws.String(volumeId),
+		Tags: []*ec2.Tag{
+			{Key: aws.String("Name"), Value: aws.String("my-name")},
+			{Key: aws.String(raidArrayTag), Value: aws.String(arrayUuid)},
+			{Key: aws.String(raidMemberTag), Value: aws.String(fmt.Sprintf("%d", member))},
+		},
+	}
+}
+
+func newRaidConfig() *Config {
+	cfg := newConfig()
+	cfg.attachAs = strPtr("xvdf")
+	cfg.raidDevices = intPtr(3)
+	return cfg
+}
+
+func TestValidateRaidRefusesSingleVolumeOptions(t *testing.T) {
+	cfg := newRaidConfig()
+	assert.NoError(t, validateRaid(*cfg))
+
+	cfg.snapshotName = strPtr("my-name")
+	assert.Error(t, validateRaid(*cfg))
+
+	cfg = newRaidConfig()
+	cfg.migrateFromOtherAz = boolPtr(true)
+	assert.Error(t, validateRaid(*cfg))
+}
+
+func TestMemberDevice(t *testing.T) {
+	device, err := memberDevice("xvdf", 2)
+	assert.NoError(t, err)
+	assert.Equal(t, "xvdh", device)
+
+	_, err = memberDevice("xvdy", 2)
+	assert.Error(t, err)
+}
+
+func TestNewArrayUuid(t *testing.T) {
+	arrayUuid, err := newArrayUuid()
+
+	assert.NoError(t, err)
+	assert.Regexp(t, regexp.MustCompile("^[0-9a-f]{8}(:[0-9a-f]{8}){3}$"), arrayUuid)
+}
+
+func TestRaidMembersOrderedByIndex(t *testing.T) {
+	arrayUuid, members, err := raidMembers([]*ec2.Volume{
+		raidVolume("vol-2", defaultArrayUuid, 2),
+		raidVolume("vol-0", defaultArrayUuid, 0),
+		raidVolume("vol-1", defaultArrayUuid, 1),
+	}, 3)
+
+	assert.NoError(t, err)
+	assert.Equal(t, defaultArrayUuid, arrayUuid)
+	assert.Equal(t, []string{"vol-0", "vol-1", "vol-2"}, members)
+}
+
+func TestRaidMembersRefusesIncompleteArray(t *testing.T) {
+	_, members, err := raidMembers([]*ec2.Volume{
+		raidVolume("vol-0", defaultArrayUuid, 0),
+		raidVolume("vol-2", defaultArrayUuid, 2),
+	}, 3)
+
+	assert.Error(t, err)
+	assert.Nil(t, members)
+}
+
+func TestCreateRaidIfNoMembersFound(t *testing.T) {
+	cfg := newRaidConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolumes", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{}, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("createRaid", "/dev/md0", mock.AnythingOfType("string"), mock.AnythingOfType("[]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, mock.AnythingOfType("map[string]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 3)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, "xvdf", *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", defaultVolumeId, "xvdh", *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "createRaid", "/dev/md0", mock.AnythingOfType("string"), []string{"/dev/xvdf", "/dev/xvdg", "/dev/xvdh"})
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", "/dev/md0", *cfg.fileSystem, defaultMkfsArgs, defaultVolumeId)
+	// The file system tags of the other two members and the mount options of all three
+	fakeAsgEbs.AssertNumberOfCalls(t, "tagVolume", 5)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/md0", *cfg.mountPoint, *cfg.fileSystem, "")
+}
+
+func TestAssembleRaidFromFoundMembers(t *testing.T) {
+	cfg := newRaidConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolumes", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{
+			raidVolume("vol-1", defaultArrayUuid, 1),
+			raidVolume("vol-0", defaultArrayUuid, 0),
+			raidVolume("vol-2", defaultArrayUuid, 2),
+		}, nil)
+	fakeAsgEbs.
+		On("attachVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("assembleRaid", "/dev/md0", defaultArrayUuid, mock.AnythingOfType("[]string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("volumeTags", mock.AnythingOfType("string")).
+		Return(map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-0", "xvdf", *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-2", "xvdh", *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "assembleRaid", "/dev/md0", defaultArrayUuid, []string{"/dev/xvdf", "/dev/xvdg", "/dev/xvdh"})
+	fakeAsgEbs.AssertNumberOfCalls(t, "makeFileSystem", 0)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/md0", *cfg.mountPoint, "ext4", "")
+}
+
+func TestRefuseRaidWithMissingMembers(t *testing.T) {
+	cfg := newRaidConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolumes", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return([]*ec2.Volume{raidVolume("vol-0", defaultArrayUuid, 0)}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 0)
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"fmt"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// mountedVolumes returns the volumes below the device mounted at the mount
+// point. A RAID array, logical volume or LUKS container is mapped back to
+// the volumes it is built on.
+func mountedVolumes(asgEbs AsgEbs, mountPoint string) ([]string, error) {
+	stack, err := asgEbs.deviceStack(mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	volumeIds := []string{}
+	for _, member := range stack.Members {
+		volumeId, err := asgEbs.findDeviceVolume(member)
+		if err != nil {
+			return nil, err
+		}
+		if volumeId != nil {
+			volumeIds = append(volumeIds, *volumeId)
+		}
+	}
+	return volumeIds, nil
+}
+
+// mountedOwnVolume returns the volume found by the tag if it is attached to
+// this instance and mounted at the mount point, as left behind by an earlier
+// run.
+func mountedOwnVolume(asgEbs AsgEbs, cfg Config) (*string, error) {
+	volumeId, err := asgEbs.findInstanceVolume(*cfg.tagKey, *cfg.tagValue)
+	if err != nil || volumeId == nil {
+		return nil, err
+	}
+	mountedVolumeIds, err := mountedVolumes(asgEbs, *cfg.mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	for _, mountedVolumeId := range mountedVolumeIds {
+		if mountedVolumeId == *volumeId {
+			return volumeId, nil
+		}
+	}
+	return nil, nil
+}
+
+// ownVolume tells whether the volume carries the tag.
+func ownVolume(asgEbs AsgEbs, cfg Config, volumeId string) (bool, error) {
+	tags, err := asgEbs.volumeTags(volumeId)
+	if err != nil {
+		return false, err
+	}
+	return tags[*cfg.tagKey] == *cfg.tagValue, nil
+}
+
+// checkPreconditions makes sure neither the device nor the mount point is in
+// use. It returns our own volume if they are in use by it: the mounted
+// volume, so re-running after everything was set up succeeds without doing
+// anything, or the attached volume, which still has to be mounted.
+func checkPreconditions(asgEbs AsgEbs, cfg Config) (*string, *string, error) {
+	attachAsDevice := "/dev/" + *cfg.attachAs
+	deviceErr := asgEbs.checkDevice(attachAsDevice)
+	mountErr := asgEbs.checkMountPoint(*cfg.mountPoint)
+
+	if mountErr != nil {
+		volumeId, err := mountedOwnVolume(asgEbs, cfg)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "mount_point": *cfg.mountPoint}).Warn("Failed to find volume mounted at mount point")
+		}
+		if volumeId != nil {
+			log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice, "mount_point": *cfg.mountPoint}).Info("Volume is already attached and mounted")
+			return volumeId, nil, nil
+		}
+		log.WithFields(log.Fields{"mount_point": *cfg.mountPoint}).Error("Already mounted")
+		return nil, nil, mountErr
+	}
+
+	// The device node is missing on NVMe instances without xvd symlinks, so
+	// the attachment is looked up even if it does not exist.
+	volumeId, err := asgEbs.findAttachedVolume(*cfg.attachAs)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "device": attachAsDevice}).Error("Failed to find volume attached as device")
+		return nil, nil, err
+	}
+	if volumeId != nil {
+		own, err := ownVolume(asgEbs, cfg, *volumeId)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Error("Failed to read tags of volume")
+			return nil, nil, err
+		}
+		if !own {
+			log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice}).Error("Device is used by another volume")
+			return nil, nil, fmt.Errorf("device %s is used by volume %s", attachAsDevice, *volumeId)
+		}
+		log.WithFields(log.Fields{"volume": *volumeId, "device": attachAsDevice}).Info("Volume is already attached, mounting it")
+		return nil, volumeId, nil
+	}
+	if deviceErr != nil {
+		log.WithFields(log.Fields{"device": attachAsDevice}).Error("Device already exists")
+		return nil, nil, deviceErr
+	}
+	return nil, nil, nil
+}
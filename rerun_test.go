@@ -0,0 +1,224 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+// attachedHere marks the volume as attached to this instance.
+func attachedHere(volume *ec2.Volume) *ec2.Volume {
+	volume.State = aws.String("in-use")
+	volume.Attachments = []*ec2.VolumeAttachment{{InstanceId: aws.String(defaultInstanceId)}}
+	return volume
+}
+
+func TestRerunWithOwnVolumeMounted(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+	fakeAsgEbs.Mounted = true
+
+	fakeAsgEbs.
+		On("findInstanceVolume", *cfg.tagKey, *cfg.tagValue).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("deviceStack", *cfg.mountPoint).
+		Return(DeviceStack{Device: "/dev/xvdf", Members: []string{"/dev/xvdf"}}, nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdf").
+		Return(defaultVolumeId, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "mountVolume", 0)
+}
+
+func TestRerunWithOtherVolumeMounted(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.Mounted = true
+
+	fakeAsgEbs.
+		On("findInstanceVolume", *cfg.tagKey, *cfg.tagValue).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("deviceStack", *cfg.mountPoint).
+		Return(DeviceStack{Device: "/dev/xvdf", Members: []string{"/dev/xvdf"}}, nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdf").
+		Return("vol-654321", nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+}
+
+func TestRerunWithDeviceOfOtherVolume(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+
+	fakeAsgEbs.
+		On("findAttachedVolume", *cfg.attachAs).
+		Return("vol-654321", nil)
+	fakeAsgEbs.
+		On("volumeTags", "vol-654321").
+		Return(map[string]string{"Name": "other"}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "deviceStack", *cfg.mountPoint)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+}
+
+func TestRerunWithRaidArrayMounted(t *testing.T) {
+	cfg := newRaidConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+	fakeAsgEbs.Mounted = true
+
+	fakeAsgEbs.
+		On("findInstanceVolume", *cfg.tagKey, *cfg.tagValue).
+		Return("vol-1", nil)
+	fakeAsgEbs.
+		On("deviceStack", *cfg.mountPoint).
+		Return(DeviceStack{Device: "/dev/md0", Layers: []string{"/dev/md0"}, Members: []string{"/dev/xvdf", "/dev/xvdg", "/dev/xvdh"}}, nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdf").
+		Return("vol-0", nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdg").
+		Return("vol-1", nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdh").
+		Return("vol-2", nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolumes", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertNumberOfCalls(t, "mountVolume", 0)
+}
+
+func TestRerunWithOwnVolumeAttachedButNotMounted(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+
+	fakeAsgEbs.
+		On("findAttachedVolume", *cfg.attachAs).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{*cfg.tagKey: *cfg.tagValue, fileSystemTypeTag: "xfs"}, nil)
+	fakeAsgEbs.
+		On("describeVolume", defaultVolumeId).
+		Return(&ec2.Volume{Size: aws.Int64(*cfg.createSize)}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "makeFileSystem", 0)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/"+*cfg.attachAs, *cfg.mountPoint, "xfs", "")
+}
+
+func TestRerunWithOwnVolumeAttachedWithoutDeviceNode(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findAttachedVolume", *cfg.attachAs).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{*cfg.tagKey: *cfg.tagValue, fileSystemTypeTag: "xfs"}, nil)
+	fakeAsgEbs.
+		On("describeVolume", defaultVolumeId).
+		Return(&ec2.Volume{Size: aws.Int64(*cfg.createSize)}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 0)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/"+*cfg.attachAs, *cfg.mountPoint, "xfs", "")
+}
+
+func TestRerunWithOtherVolumeAttachedWithoutDeviceNode(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findAttachedVolume", *cfg.attachAs).
+		Return("vol-654321", nil)
+	fakeAsgEbs.
+		On("volumeTags", "vol-654321").
+		Return(map[string]string{"Name": "other"}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+}
+
+func TestRerunWithRaidMembersAttachedButNotMounted(t *testing.T) {
+	cfg := newRaidConfig()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.DeviceExists = true
+
+	members := []*ec2.Volume{
+		attachedHere(raidVolume("vol-0", defaultArrayUuid, 0)),
+		attachedHere(raidVolume("vol-1", defaultArrayUuid, 1)),
+		attachedHere(raidVolume("vol-2", defaultArrayUuid, 2)),
+	}
+
+	fakeAsgEbs.
+		On("findAttachedVolume", "xvdf").
+		Return("vol-0", nil)
+	fakeAsgEbs.
+		On("volumeTags", mock.AnythingOfType("string")).
+		Return(map[string]string{*cfg.tagKey: *cfg.tagValue, fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("findVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(members, nil)
+	fakeAsgEbs.
+		On("findInstanceVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(members, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "assembleRaid", 0)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/md0", *cfg.mountPoint, "ext4", "")
+}
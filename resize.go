@@ -0,0 +1,189 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	volumeModificationDelay       = 15 * time.Second
+	volumeModificationMaxAttempts = 80
+	// File systems are a multiple of their block size and may leave the end
+	// of the device unused.
+	fileSystemSizeSlack = 1024 * 1024
+)
+
+func (awsAsgEbs *AwsAsgEbs) modifyVolumeSize(volumeId string, size int64) error {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	req := newerApiRequest(svc, "ModifyVolume", url.Values{
+		"VolumeId": {volumeId},
+		"Size":     {fmt.Sprintf("%d", size)},
+	}, &modifyVolumeOutput{})
+	return req.Send()
+}
+
+// waitUntilVolumeModified waits until the latest modification of the volume
+// is optimizing or completed. The new size is usable from then on.
+func (awsAsgEbs *AwsAsgEbs) waitUntilVolumeModified(volumeId string) error {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	for i := 1; i <= volumeModificationMaxAttempts; i++ {
+		output := &describeVolumesModificationsOutput{}
+		req := newerApiRequest(svc, "DescribeVolumesModifications", url.Values{
+			"VolumeId.1": {volumeId},
+		}, output)
+		err := req.Send()
+		if err != nil {
+			return err
+		}
+		if len(output.VolumesModifications) == 0 {
+			return fmt.Errorf("no modification found for volume %s", volumeId)
+		}
+		modification := output.VolumesModifications[len(output.VolumesModifications)-1]
+		state := ""
+		if modification.ModificationState != nil {
+			state = *modification.ModificationState
+		}
+		switch state {
+		case "optimizing", "completed":
+			return nil
+		case "failed":
+			message := ""
+			if modification.StatusMessage != nil {
+				message = *modification.StatusMessage
+			}
+			return fmt.Errorf("modification of volume %s failed: %s", volumeId, message)
+		}
+		log.WithFields(log.Fields{"volume": volumeId, "state": state, "attempt": i}).Info("Waiting for volume modification")
+		time.Sleep(volumeModificationDelay)
+	}
+	return fmt.Errorf("modification of volume %s timed out", volumeId)
+}
+
+// mountedFileSystem returns the description of the file system, falling back
+// to the type the mount point is mounted with if the type is not known, e.g.
+// for volumes restored from a snapshot.
+func mountedFileSystem(fileSystem string, mountPoint string) (FileSystem, error) {
+	if fileSystem == "" {
+		var err error
+		fileSystem, err = mountedFileSystemType(mountPoint)
+		if err != nil {
+			return FileSystem{}, err
+		}
+	}
+	fs, ok := fileSystems[fileSystem]
+	if !ok {
+		return FileSystem{}, fmt.Errorf("unsupported file system type %q", fileSystem)
+	}
+	return fs, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) fileSystemSize(device string, mountPoint string, fileSystem string) (int64, error) {
+	fs, err := mountedFileSystem(fileSystem, mountPoint)
+	if err != nil {
+		return 0, err
+	}
+	target := device
+	if fs.Mounted {
+		target = mountPoint
+	}
+	out, err := output(fs.Size[0], append(fs.Size[1:], target)...)
+	if err != nil {
+		return 0, err
+	}
+	return fs.ParseSize(out)
+}
+
+func (awsAsgEbs *AwsAsgEbs) deviceSize(device string) (int64, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return 0, err
+	}
+	sectors, err := ioutil.ReadFile(filepath.Join(sysBlockDir, filepath.Base(resolved), "size"))
+	if err != nil {
+		return 0, err
+	}
+	n, err := strconv.ParseInt(strings.TrimSpace(string(sectors)), 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	return n * 512, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) growFileSystem(device string, mountPoint string, fileSystem string) error {
+	fs, err := mountedFileSystem(fileSystem, mountPoint)
+	if err != nil {
+		return err
+	}
+	target := device
+	if fs.Mounted {
+		target = mountPoint
+	}
+	return run(fs.Grow[0], append(fs.Grow[1:], target)...)
+}
+
+// growMountedFileSystem grows the mounted file system if it is smaller than
+// its device, e.g. after restoring a snapshot onto a bigger volume.
+func growMountedFileSystem(asgEbs AsgEbs, device string, mountPoint string, fileSystem string) error {
+	fileSystemSize, err := asgEbs.fileSystemSize(device, mountPoint, fileSystem)
+	if err != nil {
+		return err
+	}
+	deviceSize, err := asgEbs.deviceSize(device)
+	if err != nil {
+		return err
+	}
+	fields := log.Fields{"device": device, "mount_point": mountPoint, "filesystem_size": fileSystemSize, "device_size": deviceSize}
+	if fileSystemSize+fileSystemSizeSlack >= deviceSize {
+		log.WithFields(fields).Info("File system already fills its device")
+		return nil
+	}
+	log.WithFields(fields).Info("Growing file system")
+	return asgEbs.growFileSystem(device, mountPoint, fileSystem)
+}
+
+// growVolumeFileSystem grows the mounted file system of a grown volume,
+// resizing the LUKS container in between if there is one.
+func growVolumeFileSystem(asgEbs AsgEbs, cfg Config, device string, fileSystem string) error {
+	if *cfg.luksName != "" {
+		err := resizeLuks(asgEbs, cfg)
+		if err != nil {
+			return err
+		}
+	}
+	return growMountedFileSystem(asgEbs, device, *cfg.mountPoint, fileSystem)
+}
+
+// growVolume enlarges an existing volume to the requested size and reports
+// whether it did so. Volumes are never shrunk.
+func growVolume(asgEbs AsgEbs, cfg Config, volumeId string) (bool, error) {
+	volume, err := asgEbs.describeVolume(volumeId)
+	if err != nil {
+		return false, err
+	}
+	if volume.Size == nil || *volume.Size >= *cfg.createSize {
+		return false, nil
+	}
+
+	log.WithFields(log.Fields{"volume": volumeId, "size": *volume.Size, "create_size": *cfg.createSize}).Info("Growing volume")
+	err = asgEbs.modifyVolumeSize(volumeId, *cfg.createSize)
+	if err != nil {
+		return false, err
+	}
+	err = asgEbs.waitUntilVolumeModified(volumeId)
+	if err != nil {
+		return false, err
+	}
+	return true, nil
+}
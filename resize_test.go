@@ -0,0 +1,185 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newReattachFake(size int64) *FakeAsgEbs {
+	return newReattachFakeWithTags(size, map[string]string{fileSystemTypeTag: "xfs"})
+}
+
+func newReattachFakeWithTags(size int64, tags map[string]string) *FakeAsgEbs {
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("describeVolume", defaultVolumeId).
+		Return(&ec2.Volume{VolumeId: aws.String(defaultVolumeId), Size: aws.Int64(size)}, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(tags, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+	return fakeAsgEbs
+}
+
+func TestGrowSmallerVolume(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := newReattachFake(100)
+
+	fakeAsgEbs.
+		On("modifyVolumeSize", defaultVolumeId, mock.AnythingOfType("int64")).
+		Return(nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeModified", defaultVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("fileSystemSize", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(int64(100<<30), nil)
+	fakeAsgEbs.
+		On("deviceSize", mock.AnythingOfType("string")).
+		Return(int64(200<<30), nil)
+	fakeAsgEbs.
+		On("growFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "modifyVolumeSize", defaultVolumeId, *cfg.createSize)
+	fakeAsgEbs.AssertCalled(t, "waitUntilVolumeModified", defaultVolumeId)
+	fakeAsgEbs.AssertCalled(t, "growFileSystem", "/dev/xvdc", *cfg.mountPoint, "xfs")
+}
+
+func TestNoGrowthOfLargeEnoughVolume(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := newReattachFake(300)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "modifyVolumeSize", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "growFileSystem", 0)
+}
+
+func TestMountVolumeIfGrowthFails(t *testing.T) {
+	cfg := newConfig()
+	fakeAsgEbs := newReattachFake(100)
+
+	fakeAsgEbs.
+		On("modifyVolumeSize", defaultVolumeId, mock.AnythingOfType("int64")).
+		Return(errors.New("IncorrectModificationState"))
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", *cfg.mountPoint, "xfs", "")
+	fakeAsgEbs.AssertNumberOfCalls(t, "waitUntilVolumeModified", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "growFileSystem", 0)
+}
+
+func newSnapshotRestoreFake(fileSystemSize int64) *FakeAsgEbs {
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("findSnapshot", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultSnapshotId, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{}, nil)
+	fakeAsgEbs.
+		On("detectFileSystem", "/dev/xvdc").
+		Return("ext4", nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+	fakeAsgEbs.
+		On("fileSystemSize", "/dev/xvdc", "/mnt", "ext4").
+		Return(fileSystemSize, nil)
+	fakeAsgEbs.
+		On("deviceSize", "/dev/xvdc").
+		Return(int64(200<<30), nil)
+	fakeAsgEbs.
+		On("growFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	return fakeAsgEbs
+}
+
+func TestGrowFileSystemRestoredFromSmallerSnapshot(t *testing.T) {
+	cfg := newConfig()
+	cfg.snapshotName = strPtr("my-name")
+	fakeAsgEbs := newSnapshotRestoreFake(50 << 30)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "growFileSystem", "/dev/xvdc", *cfg.mountPoint, "ext4")
+}
+
+func TestNoGrowthOfFileSystemFillingDevice(t *testing.T) {
+	cfg := newConfig()
+	cfg.snapshotName = strPtr("my-name")
+	fakeAsgEbs := newSnapshotRestoreFake(200<<30 - 4096)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "growFileSystem", 0)
+}
+
+func TestNoFileSystemGrowthIfDisabled(t *testing.T) {
+	cfg := newConfig()
+	cfg.snapshotName = strPtr("my-name")
+	cfg.growFileSystem = boolPtr(false)
+	fakeAsgEbs := newSnapshotRestoreFake(50 << 30)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "fileSystemSize", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "growFileSystem", 0)
+}
+
+func TestDeviceSizeFollowsDeviceLink(t *testing.T) {
+	root, cleanup := withFakeDevices(t)
+	defer cleanup()
+
+	writeFile(t, filepath.Join(root, "dev/dm-0"), "")
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "dev/mapper"), 0755))
+	assert.NoError(t, os.Symlink("../dm-0", filepath.Join(root, "dev/mapper/data")))
+	writeFile(t, filepath.Join(root, "sys/block/dm-0/size"), "419430400\n")
+
+	size, err := (&AwsAsgEbs{}).deviceSize(filepath.Join(root, "dev/mapper/data"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, int64(200<<30), size)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// slotTag holds the slot index of a volume. In slot mode every instance
+// claims one slot of a fixed range and always attaches the volume of that
+// slot, so it keeps its identity, e.g. the node id in a cluster.
+const slotTag = "slot"
+
+// noSlot is the slot of volumes attached without slot mode.
+const noSlot = -1
+
+func (awsAsgEbs *AwsAsgEbs) findSlotVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	params := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("tag:" + tagKey),
+				Values: []*string{
+					aws.String(tagValue),
+				},
+			},
+			{
+				Name: aws.String("tag-key"),
+				Values: []*string{
+					aws.String(slotTag),
+				},
+			},
+			{
+				Name: aws.String("status"),
+				Values: []*string{
+					aws.String("creating"),
+					aws.String("available"),
+					aws.String("in-use"),
+				},
+			},
+			{
+				Name: aws.String("availability-zone"),
+				Values: []*string{
+					aws.String(awsAsgEbs.AvailabilityZone),
+				},
+			},
+		},
+	}
+
+	describeVolumesOutput, err := svc.DescribeVolumes(params)
+	if err != nil {
+		return nil, err
+	}
+	return describeVolumesOutput.Volumes, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) instanceTag(key string) (string, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	params := &ec2.DescribeTagsInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("resource-id"),
+				Values: []*string{
+					aws.String(awsAsgEbs.InstanceId),
+				},
+			},
+			{
+				Name: aws.String("key"),
+				Values: []*string{
+					aws.String(key),
+				},
+			},
+		},
+	}
+
+	describeTagsOutput, err := svc.DescribeTags(params)
+	if err != nil {
+		return "", err
+	}
+	if len(describeTagsOutput.Tags) == 0 {
+		return "", fmt.Errorf("instance %s has no tag %s", awsAsgEbs.InstanceId, key)
+	}
+	return *describeTagsOutput.Tags[0].Value, nil
+}
+
+func validateSlots(cfg Config) error {
+	if *cfg.slots < 0 || *cfg.firstSlot < 0 {
+		return errors.New("--slots and --first-slot must not be negative")
+	}
+	if *cfg.slots == 0 {
+		if *cfg.slotFromTag != "" || *cfg.slotFile != "" {
+			return errors.New("--slot-from-tag and --slot-file need --slots")
+		}
+		return nil
+	}
+	if *cfg.raidDevices > 0 {
+		return errors.New("--slots cannot be combined with --raid-devices")
+	}
+	return nil
+}
+
+// slotRange lists the configured slots in ascending order.
+func slotRange(cfg Config) []int {
+	slots := []int{}
+	for i := 0; i < *cfg.slots; i++ {
+		slots = append(slots, *cfg.firstSlot+i)
+	}
+	return slots
+}
+
+// parseSlot reads a slot index and makes sure it is in the configured range.
+func parseSlot(cfg Config, value string) (int, error) {
+	slot, err := strconv.Atoi(strings.TrimSpace(value))
+	if err != nil {
+		return 0, fmt.Errorf("invalid slot %q", value)
+	}
+	if slot < *cfg.firstSlot || slot >= *cfg.firstSlot+*cfg.slots {
+		return 0, fmt.Errorf("slot %d is not between %d and %d", slot, *cfg.firstSlot, *cfg.firstSlot+*cfg.slots-1)
+	}
+	return slot, nil
+}
+
+// slotVolumes groups the volumes by their slot, ignoring volumes with slots
+// outside the configured range.
+func slotVolumes(cfg Config, volumes []*ec2.Volume) map[int][]*ec2.Volume {
+	bySlot := map[int][]*ec2.Volume{}
+	for _, volume := range volumes {
+		for _, tag := range volume.Tags {
+			if *tag.Key != slotTag {
+				continue
+			}
+			slot, err := parseSlot(cfg, *tag.Value)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": *volume.VolumeId}).Warn("Ignoring volume with invalid slot")
+				continue
+			}
+			bySlot[slot] = append(bySlot[slot], volume)
+		}
+	}
+	return bySlot
+}
+
+// attachableSlotVolume tells whether a volume of a slot is free to be
+// claimed. Volumes which are attached elsewhere or still being created keep
+// their slot taken.
+func attachableSlotVolume(volume *ec2.Volume) bool {
+	return volume.State != nil && *volume.State == "available"
+}
+
+// formattedSlotVolume tells whether a volume of a slot has a file system.
+// Volumes left behind by instances which failed before creating it are
+// formatted by the instance attaching them.
+func formattedSlotVolume(volume *ec2.Volume) bool {
+	for _, tag := range volume.Tags {
+		if *tag.Key == "filesystem" {
+			return *tag.Value == "true"
+		}
+	}
+	return false
+}
+
+// attachSlotVolume picks the slot of this instance, either from the instance
+// tag or the lowest free one, and attaches the volume of the slot. It
+// returns no volume if the slot has none yet, so one is created for it, and
+// whether the attached volume still has to be formatted. Slots lost to other
+// instances creating their volume at the same time are skipped. Volumes are
+// claimed before attaching them unless the claim TTL is 0.
+func attachSlotVolume(asgEbs AsgEbs, cfg Config, takenSlots map[int]bool) (int, *string, bool, error) {
+	slots := slotRange(cfg)
+	if *cfg.slotFromTag != "" {
+		value, err := asgEbs.instanceTag(*cfg.slotFromTag)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "tag": *cfg.slotFromTag}).Error("Failed to read slot from instance tag")
+			return noSlot, nil, false, err
+		}
+		slot, err := parseSlot(cfg, value)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "tag": *cfg.slotFromTag}).Error("Invalid slot in instance tag")
+			return noSlot, nil, false, err
+		}
+		slots = []int{slot}
+	}
+
+	volumes, err := asgEbs.findSlotVolumes(*cfg.tagKey, *cfg.tagValue)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Error("Failed to find volumes of slots")
+		return noSlot, nil, false, err
+	}
+	bySlot := slotVolumes(cfg, volumes)
+
+	claimer := newVolumeClaimer(asgEbs, cfg)
+	for _, slot := range slots {
+		if takenSlots[slot] {
+			continue
+		}
+		if len(bySlot[slot]) == 0 {
+			log.WithFields(log.Fields{"slot": slot}).Info("Slot has no volume yet")
+			return slot, nil, false, nil
+		}
+		for _, volume := range bySlot[slot] {
+			volumeId := *volume.VolumeId
+			if !attachableSlotVolume(volume) {
+				continue
+			}
+			if claimer.enabled() {
+				claimed, err := claimer.claim(volumeId)
+				if err != nil {
+					log.WithFields(log.Fields{"error": err, "volume": volumeId, "slot": slot}).Warn("Failed to claim volume")
+					continue
+				}
+				if !claimed {
+					continue
+				}
+			}
+			err = checkEncryption(asgEbs, cfg, volumeId)
+			if err != nil {
+				return noSlot, nil, false, err
+			}
+			log.WithFields(log.Fields{"volume": volumeId, "slot": slot, "device": "/dev/" + *cfg.attachAs}).Info("Trying to attach volume of slot")
+			err = asgEbs.attachVolume(volumeId, *cfg.attachAs, *cfg.deleteOnTermination)
+			if err != nil {
+				log.WithFields(log.Fields{"error": err, "volume": volumeId}).Warn("Failed to attach volume")
+				continue
+			}
+			formatted := formattedSlotVolume(volume)
+			if !formatted {
+				log.WithFields(log.Fields{"volume": volumeId, "slot": slot}).Info("Volume of slot has no file system yet")
+			}
+			return slot, &volumeId, !formatted, nil
+		}
+		log.WithFields(log.Fields{"slot": slot}).Info("Slot is taken")
+	}
+
+	if *cfg.slotFromTag != "" {
+		err = fmt.Errorf("slot %d is taken", slots[0])
+	} else {
+		err = fmt.Errorf("all %d slots are taken", len(slots))
+	}
+	log.WithFields(log.Fields{"error": err}).Error("No free slot")
+	return noSlot, nil, false, err
+}
+
+// exportSlot writes the slot of the attached volume to the slot file, for
+// the application to use it as its node id.
+func exportSlot(cfg Config, slot int) error {
+	if slot == noSlot {
+		return nil
+	}
+	log.WithFields(log.Fields{"slot": slot, "file": *cfg.slotFile}).Info("Attached volume of slot")
+	if *cfg.slotFile == "" {
+		return nil
+	}
+	err := writeFileAtomically(*cfg.slotFile, fmt.Sprintf("%d\n", slot))
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "file": *cfg.slotFile}).Error("Failed to write slot file")
+	}
+	return err
+}
+
+// exportMountedSlot exports the slot of a volume mounted by an earlier run
+// again, as the slot file may be gone after a reboot.
+func exportMountedSlot(asgEbs AsgEbs, cfg Config, volumeId string) error {
+	if *cfg.slots == 0 {
+		return nil
+	}
+	tags, err := asgEbs.volumeTags(volumeId)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Failed to read tags of volume")
+		return err
+	}
+	slot, err := parseSlot(cfg, tags[slotTag])
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": volumeId}).Error("Mounted volume has no valid slot")
+		return err
+	}
+	return exportSlot(cfg, slot)
+}
@@ -0,0 +1,343 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func slotVolume(volumeId string, slot int, state string) *ec2.Volume {
+	return &ec2.Volume{
+		VolumeId: aws.String(volumeId),
+		State:    aws.String(state),
+		Size:     aws.Int64(200),
+		Tags: []*ec2.Tag{
+			{Key: aws.String(slotTag), Value: aws.String(strconv.Itoa(slot))},
+			{Key: aws.String("filesystem"), Value: aws.String("true")},
+		},
+	}
+}
+
+func newSlotConfig(t *testing.T) (*Config, func()) {
+	dir, err := ioutil.TempDir("", "slot")
+	assert.NoError(t, err)
+	cfg := newConfig()
+	cfg.slots = intPtr(3)
+	cfg.slotFile = strPtr(filepath.Join(dir, "slot"))
+	cfg.claimTtl = durationPtr(2 * time.Minute)
+	return cfg, func() { os.RemoveAll(dir) }
+}
+
+// newSlotFake mocks attaching and mounting an existing volume of a slot.
+func newSlotFake(cfg *Config, volumes []*ec2.Volume, volumeId string) *FakeAsgEbs {
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findSlotVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return(volumes, nil)
+	withVolumeTags(fakeAsgEbs, volumeId, map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("attachVolume", volumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("describeVolume", volumeId).
+		Return(&ec2.Volume{Size: aws.Int64(200)}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	return fakeAsgEbs
+}
+
+func assertSlotFile(t *testing.T, cfg *Config, slot string) {
+	content, err := ioutil.ReadFile(*cfg.slotFile)
+	assert.NoError(t, err)
+	assert.Equal(t, slot+"\n", string(content))
+}
+
+func TestParseSlot(t *testing.T) {
+	cfg := newConfig()
+	cfg.slots = intPtr(3)
+	cfg.firstSlot = intPtr(1)
+
+	assert.Equal(t, []int{1, 2, 3}, slotRange(*cfg))
+	slot, err := parseSlot(*cfg, " 3\n")
+	assert.NoError(t, err)
+	assert.Equal(t, 3, slot)
+	_, err = parseSlot(*cfg, "0")
+	assert.Error(t, err)
+	_, err = parseSlot(*cfg, "4")
+	assert.Error(t, err)
+	_, err = parseSlot(*cfg, "node-1")
+	assert.Error(t, err)
+}
+
+func TestValidateSlots(t *testing.T) {
+	cfg := newConfig()
+	assert.NoError(t, validateSlots(*cfg))
+
+	cfg.slotFromTag = strPtr("node-id")
+	assert.Error(t, validateSlots(*cfg))
+
+	cfg.slots = intPtr(3)
+	assert.NoError(t, validateSlots(*cfg))
+
+	cfg.raidDevices = intPtr(2)
+	assert.Error(t, validateSlots(*cfg))
+}
+
+func TestAttachVolumeOfLowestFreeSlot(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	volumes := []*ec2.Volume{
+		slotVolume("vol-2", 2, "available"),
+		slotVolume("vol-0", 0, "in-use"),
+		slotVolume("vol-1", 1, "available"),
+	}
+	fakeAsgEbs := newSlotFake(cfg, volumes, "vol-1")
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "findVolume", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 1)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-1", *cfg.attachAs, *cfg.deleteOnTermination)
+	assertSlotFile(t, cfg, "1")
+}
+
+func TestSkipSlotClaimedByOtherInstance(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	volumes := []*ec2.Volume{
+		slotVolume("vol-0", 0, "available"),
+		slotVolume("vol-1", 1, "available"),
+	}
+	fakeAsgEbs := newSlotFake(cfg, volumes, "vol-1")
+	competingClaim := map[string]string{claimedByTag: "i-654321", claimedAtTag: "2999-01-01T00:00:00Z"}
+	withVolumeTags(fakeAsgEbs, "vol-0", map[string]string{}, competingClaim)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNotCalled(t, "attachVolume", "vol-0", *cfg.attachAs, *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-1", *cfg.attachAs, *cfg.deleteOnTermination)
+	assertSlotFile(t, cfg, "1")
+}
+
+func TestAttachVolumeOfSlotWithoutClaiming(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	cfg.claimTtl = durationPtr(0)
+	volumes := []*ec2.Volume{
+		slotVolume("vol-0", 0, "available"),
+	}
+	fakeAsgEbs := newSlotFake(cfg, volumes, "vol-0")
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-0", *cfg.attachAs, *cfg.deleteOnTermination)
+	claims := mock.MatchedBy(func(tags map[string]string) bool {
+		_, ok := tags[claimedByTag]
+		return ok
+	})
+	fakeAsgEbs.AssertNotCalled(t, "tagVolume", "vol-0", claims)
+	assertSlotFile(t, cfg, "0")
+}
+
+func TestCreateVolumeForFreeSlot(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findSlotVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{slotVolume("vol-0", 0, "in-use")}, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", defaultVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("findCreatedVolumes", createdFor(*cfg, 1)).
+		Return([]*ec2.Volume{}, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), defaultVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	claimsSlot := mock.MatchedBy(func(tags map[string]string) bool {
+		return tags[slotTag] == "1" && tags[claimedByTag] == defaultInstanceId
+	})
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, *cfg.createVolumeType, claimsSlot, (*string)(nil), VolumeOptions{})
+	assertSlotFile(t, cfg, "1")
+}
+
+func TestFormatUnformattedVolumeOfSlot(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	unformatted := slotVolume("vol-0", 0, "available")
+	unformatted.Tags[1].Value = aws.String("false")
+	fakeAsgEbs := newSlotFake(cfg, []*ec2.Volume{unformatted}, "vol-0")
+
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), "vol-0").
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-0", *cfg.attachAs, *cfg.deleteOnTermination)
+	fakeAsgEbs.AssertCalled(t, "makeFileSystem", "/dev/"+*cfg.attachAs, *cfg.fileSystem, defaultMkfsArgs, "vol-0")
+	assertSlotFile(t, cfg, "0")
+}
+
+func TestCreateVolumeForNextSlotAfterLosingCreation(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	cfg.claimDelay = durationPtr(0)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	earlier := time.Now().Add(-time.Second)
+
+	fakeAsgEbs.
+		On("findSlotVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{}, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", defaultVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("findCreatedVolumes", createdFor(*cfg, 0)).
+		Return([]*ec2.Volume{{VolumeId: aws.String("vol-other"), CreateTime: &earlier}}, nil)
+	fakeAsgEbs.
+		On("findCreatedVolumes", createdFor(*cfg, 1)).
+		Return([]*ec2.Volume{}, nil)
+	fakeAsgEbs.
+		On("deleteVolume", defaultVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), defaultVolumeId).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", defaultVolumeId, map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 2)
+	fakeAsgEbs.AssertNumberOfCalls(t, "deleteVolume", 1)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 1)
+	assertSlotFile(t, cfg, "1")
+}
+
+func TestAttachVolumeOfSlotFromInstanceTag(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	cfg.slotFromTag = strPtr("node-id")
+	volumes := []*ec2.Volume{
+		slotVolume("vol-0", 0, "available"),
+		slotVolume("vol-2", 2, "available"),
+	}
+	fakeAsgEbs := newSlotFake(cfg, volumes, "vol-2")
+
+	fakeAsgEbs.
+		On("instanceTag", "node-id").
+		Return("2", nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 1)
+	fakeAsgEbs.AssertCalled(t, "attachVolume", "vol-2", *cfg.attachAs, *cfg.deleteOnTermination)
+	assertSlotFile(t, cfg, "2")
+}
+
+func TestFailIfSlotFromInstanceTagIsTaken(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	cfg.slotFromTag = strPtr("node-id")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("instanceTag", "node-id").
+		Return("0", nil)
+	fakeAsgEbs.
+		On("findSlotVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{slotVolume("vol-0", 0, "in-use"), slotVolume("vol-1", 1, "available")}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "attachVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+}
+
+func TestFailIfAllSlotsAreTaken(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	cfg.slots = intPtr(2)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findSlotVolumes", *cfg.tagKey, *cfg.tagValue).
+		Return([]*ec2.Volume{slotVolume("vol-0", 0, "in-use"), slotVolume("vol-1", 1, "creating")}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+}
+
+func TestRerunExportsSlotOfMountedVolume(t *testing.T) {
+	cfg, cleanup := newSlotConfig(t)
+	defer cleanup()
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+	fakeAsgEbs.Mounted = true
+
+	fakeAsgEbs.
+		On("findInstanceVolume", *cfg.tagKey, *cfg.tagValue).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("deviceStack", *cfg.mountPoint).
+		Return(DeviceStack{Device: "/dev/xvdf", Members: []string{"/dev/xvdf"}}, nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdf").
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("volumeTags", defaultVolumeId).
+		Return(map[string]string{slotTag: "2"}, nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	assertSlotFile(t, cfg, "2")
+}
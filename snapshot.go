@@ -0,0 +1,209 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// mountedVolume returns the volume mounted at the mount point, also through
+// LUKS, RAID or LVM. A mount point spanning several volumes can not be
+// captured by a single snapshot.
+func mountedVolume(asgEbs AsgEbs, mountPoint string) (*string, error) {
+	volumeIds, err := mountedVolumes(asgEbs, mountPoint)
+	if err != nil {
+		return nil, err
+	}
+	switch len(volumeIds) {
+	case 0:
+		return nil, nil
+	case 1:
+		return &volumeIds[0], nil
+	default:
+		return nil, fmt.Errorf("mount point %s spans %d volumes %s, only single volumes can be snapshotted", mountPoint, len(volumeIds), strings.Join(volumeIds, ", "))
+	}
+}
+
+func (awsAsgEbs *AwsAsgEbs) findDeviceVolume(device string) (*string, error) {
+	if volumeId, ok := deviceVolumeId(device); ok {
+		return &volumeId, nil
+	}
+	return awsAsgEbs.findAttachedVolume(strings.TrimPrefix(device, "/dev/"))
+}
+
+func (awsAsgEbs *AwsAsgEbs) findInstanceVolume(tagKey string, tagValue string) (*string, error) {
+	volumes, err := awsAsgEbs.findInstanceVolumes(tagKey, tagValue)
+	if err != nil {
+		return nil, err
+	}
+	if len(volumes) == 0 {
+		return nil, nil
+	}
+	return volumes[0].VolumeId, nil
+}
+
+// findInstanceVolumes returns the volumes with the tag which are attached to
+// this instance.
+func (awsAsgEbs *AwsAsgEbs) findInstanceVolumes(tagKey string, tagValue string) ([]*ec2.Volume, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	params := &ec2.DescribeVolumesInput{
+		Filters: []*ec2.Filter{
+			{
+				Name: aws.String("tag:" + tagKey),
+				Values: []*string{
+					aws.String(tagValue),
+				},
+			},
+			{
+				Name: aws.String("attachment.instance-id"),
+				Values: []*string{
+					aws.String(awsAsgEbs.InstanceId),
+				},
+			},
+		},
+	}
+
+	describeVolumesOutput, err := svc.DescribeVolumes(params)
+	if err != nil {
+		return nil, err
+	}
+	return describeVolumesOutput.Volumes, nil
+}
+
+// ownTags are the tags asg-ebs manages itself. Only the ones in dataTagKeys
+// describe the data, the others record where a volume is used and what
+// happened to it, like claims, slots, RAID and LVM membership, mount options
+// and fsck results, and only hold for the original volume.
+var ownTags = []string{
+	"filesystem", fileSystemTypeTag, fileSystemUuidTag, luksTag,
+	claimedByTag, claimedAtTag, releasedTag, createdForTag, slotTag,
+	raidArrayTag, raidMemberTag, lvmGroupTag, lvmMemberTag, lvmMembersTag,
+	mountOptionsTag, fsckTag, fsckTimeTag, transientTag,
+}
+
+var dataTagKeys = map[string]bool{
+	"filesystem":      true,
+	fileSystemTypeTag: true,
+	fileSystemUuidTag: true,
+	luksTag:           true,
+}
+
+// dataTags returns the tags describing the data on a volume or snapshot,
+// which are carried over to its snapshots and restored volumes: the data
+// tags of asg-ebs and the tags of the user. Tags in the aws: namespace are
+// reserved.
+func dataTags(tags map[string]string) map[string]string {
+	copied := map[string]string{}
+	for k, v := range tags {
+		if !strings.HasPrefix(k, "aws:") {
+			copied[k] = v
+		}
+	}
+	for _, k := range ownTags {
+		if !dataTagKeys[k] {
+			delete(copied, k)
+		}
+	}
+	return copied
+}
+
+func (awsAsgEbs *AwsAsgEbs) createSnapshot(volumeId string, snapshotName string, createTags map[string]string) (*string, error) {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	volumeTags, err := awsAsgEbs.volumeTags(volumeId)
+	if err != nil {
+		return nil, err
+	}
+
+	createSnapshotInput := &ec2.CreateSnapshotInput{
+		VolumeId:    aws.String(volumeId),
+		Description: aws.String(snapshotName),
+	}
+	snapshot, err := svc.CreateSnapshot(createSnapshotInput)
+	if err != nil {
+		return nil, err
+	}
+
+	tags := dataTags(volumeTags)
+	tags["Name"] = snapshotName
+	for k, v := range createTags {
+		tags[k] = v
+	}
+	err = tagResource(svc, *snapshot.SnapshotId, tags)
+	if err != nil {
+		return snapshot.SnapshotId, err
+	}
+
+	return snapshot.SnapshotId, nil
+}
+
+// transientTag marks snapshots which are only taken to create a volume from
+// them and deleted once it is available.
+const transientTag = "transient"
+
+// deleteTransientSnapshots deletes snapshots which were only taken to create
+// a volume from them, once that volume is available.
+func deleteTransientSnapshots(asgEbs AsgEbs, snapshotIds []string) {
+	for _, snapshotId := range snapshotIds {
+		log.WithFields(log.Fields{"snapshot": snapshotId}).Info("Deleting transient snapshot")
+		err := asgEbs.deleteSnapshot(snapshotId)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "snapshot": snapshotId}).Warn("Failed to delete transient snapshot")
+		}
+	}
+}
+
+func (awsAsgEbs *AwsAsgEbs) waitUntilSnapshotCompleted(snapshotId string) error {
+	svc := ec2.New(session.New(awsAsgEbs.AwsConfig))
+
+	describeSnapshotsInput := &ec2.DescribeSnapshotsInput{
+		SnapshotIds: []*string{aws.String(snapshotId)},
+	}
+	return svc.WaitUntilSnapshotCompleted(describeSnapshotsInput)
+}
+
+type SnapshotConfig struct {
+	mountPoint   *string
+	tagKey       *string
+	tagValue     *string
+	snapshotName *string
+	createTags   *map[string]string
+	wait         *bool
+}
+
+func runSnapshot(asgEbs AsgEbs, cfg SnapshotConfig) {
+	var volumeId *string
+	var err error
+
+	if *cfg.mountPoint != "" {
+		volumeId, err = mountedVolume(asgEbs, *cfg.mountPoint)
+	} else {
+		volumeId, err = asgEbs.findInstanceVolume(*cfg.tagKey, *cfg.tagValue)
+	}
+	if err != nil {
+		log.WithFields(log.Fields{"error": err}).Fatal("Failed to find volume")
+	}
+	if volumeId == nil {
+		log.Fatal("No attached volume found")
+	}
+
+	log.WithFields(log.Fields{"volume": *volumeId, "snapshot_name": *cfg.snapshotName}).Info("Creating snapshot")
+	snapshotId, err := asgEbs.createSnapshot(*volumeId, *cfg.snapshotName, *cfg.createTags)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "volume": *volumeId}).Fatal("Failed to create snapshot")
+	}
+
+	if *cfg.wait {
+		log.WithFields(log.Fields{"snapshot": *snapshotId}).Info("Waiting until snapshot is completed")
+		err = asgEbs.waitUntilSnapshotCompleted(*snapshotId)
+		if err != nil {
+			log.WithFields(log.Fields{"error": err, "snapshot": *snapshotId}).Fatal("Waiting for snapshot timed out")
+		}
+	}
+}
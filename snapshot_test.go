@@ -0,0 +1,119 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func newSnapshotConfig() *SnapshotConfig {
+	return &SnapshotConfig{
+		mountPoint:   strPtr("/mnt"),
+		tagKey:       strPtr(""),
+		tagValue:     strPtr(""),
+		snapshotName: strPtr("my-name"),
+		createTags:   &map[string]string{"team": "my-team"},
+		wait:         boolPtr(false),
+	}
+}
+
+func TestSnapshotMountedVolume(t *testing.T) {
+	cfg := newSnapshotConfig()
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("deviceStack", *cfg.mountPoint).
+		Return(DeviceStack{Device: "/dev/mapper/data", Layers: []string{"/dev/mapper/data"}, Members: []string{"/dev/xvdf"}}, nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdf").
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("createSnapshot", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string")).
+		Return(defaultSnapshotId, nil)
+
+	runSnapshot(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertCalled(t, "deviceStack", *cfg.mountPoint)
+	fakeAsgEbs.AssertNotCalled(t, "findInstanceVolume", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertCalled(t, "createSnapshot", defaultVolumeId, *cfg.snapshotName, *cfg.createTags)
+	fakeAsgEbs.AssertNotCalled(t, "waitUntilSnapshotCompleted", defaultSnapshotId)
+}
+
+func TestSnapshotTaggedVolumeAndWait(t *testing.T) {
+	cfg := newSnapshotConfig()
+	cfg.mountPoint = strPtr("")
+	cfg.tagKey = strPtr("Name")
+	cfg.tagValue = strPtr("my-name")
+	cfg.wait = boolPtr(true)
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("findInstanceVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("createSnapshot", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string")).
+		Return(defaultSnapshotId, nil)
+	fakeAsgEbs.
+		On("waitUntilSnapshotCompleted", defaultSnapshotId).
+		Return(nil)
+
+	runSnapshot(fakeAsgEbs, *cfg)
+
+	fakeAsgEbs.AssertCalled(t, "findInstanceVolume", *cfg.tagKey, *cfg.tagValue)
+	fakeAsgEbs.AssertCalled(t, "createSnapshot", defaultVolumeId, *cfg.snapshotName, *cfg.createTags)
+	fakeAsgEbs.AssertCalled(t, "waitUntilSnapshotCompleted", defaultSnapshotId)
+}
+
+func TestMountedVolumeRefusesMountSpanningVolumes(t *testing.T) {
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("deviceStack", "/mnt").
+		Return(DeviceStack{Device: "/dev/md0", Layers: []string{"/dev/md0"}, Members: []string{"/dev/xvdf", "/dev/xvdg"}}, nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdf").
+		Return("vol-0", nil)
+	fakeAsgEbs.
+		On("findDeviceVolume", "/dev/xvdg").
+		Return("vol-1", nil)
+
+	volumeId, err := mountedVolume(fakeAsgEbs, "/mnt")
+
+	assert.Error(t, err)
+	assert.Nil(t, volumeId)
+}
+
+func TestDataTagsKeepOnlyDataAndUserTags(t *testing.T) {
+	tags := dataTags(map[string]string{
+		"Name":            "my-name",
+		"team":            "my-team",
+		"aws:backup":      "daily",
+		"filesystem":      "true",
+		claimedByTag:      defaultInstanceId,
+		claimedAtTag:      "2016-01-02T15:04:05Z",
+		releasedTag:       "2016-01-02T15:04:05Z",
+		createdForTag:     "my-key=my-value",
+		slotTag:           "2",
+		raidArrayTag:      defaultArrayUuid,
+		raidMemberTag:     "1",
+		lvmGroupTag:       defaultGroupId,
+		lvmMemberTag:      "1",
+		lvmMembersTag:     "2",
+		mountOptionsTag:   "noatime",
+		fsckTag:           fsckClean,
+		fsckTimeTag:       "2016-01-02T15:04:05Z",
+		fileSystemTypeTag: "xfs",
+		fileSystemUuidTag: "0123-4567",
+		luksTag:           "true",
+	})
+
+	assert.Equal(t, map[string]string{
+		"Name":            "my-name",
+		"team":            "my-team",
+		"filesystem":      "true",
+		fileSystemTypeTag: "xfs",
+		fileSystemUuidTag: "0123-4567",
+		luksTag:           "true",
+	}, tags)
+}
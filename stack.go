@@ -0,0 +1,84 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// DeviceStack describes a device built on top of volumes, like a RAID array
+// or an LVM logical volume. Layers are the devices stacked on the volumes,
+// topmost first, and Members are the devices of the volumes themselves. A
+// plain volume has no layers and is its own only member.
+type DeviceStack struct {
+	Device  string
+	Layers  []string
+	Members []string
+}
+
+// resolveDeviceStack follows the slaves of the device in sysfs down to the
+// devices which have none.
+func resolveDeviceStack(device string) (DeviceStack, error) {
+	resolved, err := filepath.EvalSymlinks(device)
+	if err != nil {
+		return DeviceStack{}, err
+	}
+	stack := DeviceStack{Device: device}
+	names := []string{filepath.Base(resolved)}
+	for len(names) > 0 {
+		name := names[0]
+		names = names[1:]
+		slaves, err := ioutil.ReadDir(filepath.Join(sysBlockDir, name, "slaves"))
+		if err != nil && !os.IsNotExist(err) {
+			return DeviceStack{}, err
+		}
+		if len(slaves) == 0 {
+			stack.Members = append(stack.Members, filepath.Join(devDir, name))
+			continue
+		}
+		stack.Layers = append(stack.Layers, filepath.Join(devDir, name))
+		for _, slave := range slaves {
+			names = append(names, slave.Name())
+		}
+	}
+	return stack, nil
+}
+
+func (awsAsgEbs *AwsAsgEbs) deviceStack(mountPoint string) (DeviceStack, error) {
+	device, err := mountedDevice(mountPoint)
+	if err != nil {
+		return DeviceStack{}, err
+	}
+	return resolveDeviceStack(device)
+}
+
+// closeDevice stops a RAID array, deactivates the volume group of a logical
+// volume or closes a LUKS container, so that the volumes below can be
+// detached.
+func (awsAsgEbs *AwsAsgEbs) closeDevice(device string) error {
+	name := filepath.Base(device)
+	if strings.HasPrefix(name, "md") {
+		return run("/sbin/mdadm", "--stop", device)
+	}
+	uuid, err := ioutil.ReadFile(filepath.Join(sysBlockDir, name, "dm", "uuid"))
+	if err != nil {
+		return err
+	}
+	if strings.HasPrefix(string(uuid), "LVM-") {
+		out, err := output("/sbin/lvs", "--noheadings", "-o", "vg_name", device)
+		if err != nil {
+			return err
+		}
+		return run("/sbin/vgchange", "-an", strings.TrimSpace(out))
+	}
+	if strings.HasPrefix(string(uuid), "CRYPT-") {
+		dmName, err := ioutil.ReadFile(filepath.Join(sysBlockDir, name, "dm", "name"))
+		if err != nil {
+			return err
+		}
+		return run("/sbin/cryptsetup", "close", strings.TrimSpace(string(dmName)))
+	}
+	return fmt.Errorf("unsupported device %s", device)
+}
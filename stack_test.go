@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestResolveDeviceStackOfPlainVolume(t *testing.T) {
+	root, cleanup := withFakeDevices(t)
+	defer cleanup()
+
+	writeFile(t, filepath.Join(root, "dev/xvdf"), "")
+
+	stack, err := resolveDeviceStack(filepath.Join(root, "dev/xvdf"))
+
+	assert.NoError(t, err)
+	assert.Empty(t, stack.Layers)
+	assert.Equal(t, []string{filepath.Join(root, "dev/xvdf")}, stack.Members)
+}
+
+func TestResolveDeviceStackOfVolumeGroupOnRaid(t *testing.T) {
+	root, cleanup := withFakeDevices(t)
+	defer cleanup()
+
+	writeFile(t, filepath.Join(root, "dev/dm-0"), "")
+	assert.NoError(t, os.MkdirAll(filepath.Join(root, "dev/mapper"), 0755))
+	assert.NoError(t, os.Symlink("../dm-0", filepath.Join(root, "dev/mapper/vg0-data")))
+	writeFile(t, filepath.Join(root, "sys/block/dm-0/slaves/md0"), "")
+	writeFile(t, filepath.Join(root, "sys/block/md0/slaves/xvdf"), "")
+	writeFile(t, filepath.Join(root, "sys/block/md0/slaves/xvdg"), "")
+
+	stack, err := resolveDeviceStack(filepath.Join(root, "dev/mapper/vg0-data"))
+
+	assert.NoError(t, err)
+	assert.Equal(t, filepath.Join(root, "dev/mapper/vg0-data"), stack.Device)
+	assert.Equal(t, []string{filepath.Join(root, "dev/dm-0"), filepath.Join(root, "dev/md0")}, stack.Layers)
+	assert.Equal(t, []string{filepath.Join(root, "dev/xvdf"), filepath.Join(root, "dev/xvdg")}, stack.Members)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode"
+
+	"gopkg.in/alecthomas/kingpin.v2"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+// splitArgs splits a volume spec into arguments like a shell does. Single
+// quotes keep everything up to the closing quote, double quotes allow
+// escaping \" and \\, and a backslash outside of quotes escapes the next
+// character.
+func splitArgs(spec string) ([]string, error) {
+	args := []string{}
+	var arg bytes.Buffer
+	inArg := false
+	var quote rune
+	escaped := false
+	for _, c := range spec {
+		switch {
+		case escaped:
+			if quote == '"' && c != '"' && c != '\\' {
+				arg.WriteRune('\\')
+			}
+			arg.WriteRune(c)
+			escaped = false
+		case c == '\\' && quote != '\'':
+			escaped = true
+			inArg = true
+		case quote != 0:
+			if c == quote {
+				quote = 0
+			} else {
+				arg.WriteRune(c)
+			}
+		case c == '\'' || c == '"':
+			quote = c
+			inArg = true
+		case unicode.IsSpace(c):
+			if inArg {
+				args = append(args, arg.String())
+				arg.Reset()
+				inArg = false
+			}
+		default:
+			arg.WriteRune(c)
+			inArg = true
+		}
+	}
+	if escaped {
+		return nil, errors.New("trailing backslash")
+	}
+	if quote != 0 {
+		return nil, fmt.Errorf("unterminated %c quote", quote)
+	}
+	if inArg {
+		args = append(args, arg.String())
+	}
+	return args, nil
+}
+
+// parseVolumeSpec parses the attach flags of a single volume.
+func parseVolumeSpec(spec string, maxRetries *int) (*Config, error) {
+	args, err := splitArgs(spec)
+	if err != nil {
+		return nil, err
+	}
+	app := kingpin.New("volume", "")
+	cfg := attachFlags(app)
+	cfg.maxRetries = maxRetries
+	_, err = app.Parse(args)
+	if err != nil {
+		return nil, err
+	}
+	return cfg, nil
+}
+
+// parseVolumeSpecs parses the volumes given in the volumes file, one per
+// line, followed by the ones given on the command line. Empty lines and lines
+// starting with # are ignored.
+func parseVolumeSpecs(volumesFile string, specs []string, maxRetries *int) ([]Config, error) {
+	lines := []string{}
+	if volumesFile != "" {
+		for _, line := range strings.Split(slurpFile(volumesFile), "\n") {
+			line = strings.TrimSpace(line)
+			if line == "" || strings.HasPrefix(line, "#") {
+				continue
+			}
+			lines = append(lines, line)
+		}
+	}
+	lines = append(lines, specs...)
+
+	if len(lines) == 0 {
+		return nil, errors.New("no volumes given")
+	}
+
+	cfgs := []Config{}
+	for i, line := range lines {
+		cfg, err := parseVolumeSpec(line, maxRetries)
+		if err != nil {
+			return nil, fmt.Errorf("volume %d: %s", i+1, err)
+		}
+		cfgs = append(cfgs, *cfg)
+	}
+	return cfgs, nil
+}
+
+// runAttachVolumes attaches all volumes in the given order. A failing volume
+// does not stop the remaining ones, but makes the whole run fail.
+func runAttachVolumes(asgEbs AsgEbs, cfgs []Config) error {
+	failed := 0
+	for _, cfg := range cfgs {
+		fields := log.Fields{"tag_key": *cfg.tagKey, "tag_value": *cfg.tagValue, "mount_point": *cfg.mountPoint}
+		log.WithFields(fields).Info("Processing volume")
+		err := runAsgEbs(asgEbs, cfg)
+		if err != nil {
+			failed++
+			log.WithFields(fields).WithField("error", err).Error("Volume failed")
+		} else {
+			log.WithFields(fields).Info("Volume ready")
+		}
+	}
+
+	log.WithFields(log.Fields{"total": len(cfgs), "failed": failed}).Info("Processed volumes")
+	if failed > 0 {
+		return fmt.Errorf("%d of %d volumes failed", failed, len(cfgs))
+	}
+	return nil
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestParseVolumeSpecs(t *testing.T) {
+	file, err := ioutil.TempFile("", "volumes")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(file.Name())
+	file.WriteString("# data volume\n" +
+		"--tag-key=Name --tag-value=data --attach-as=xvdf --mount-point=/data --create-size=10 --create-name=data --create-volume-type=gp2\n" +
+		"\n")
+	file.Close()
+
+	cfgs, err := parseVolumeSpecs(file.Name(), []string{
+		"--tag-key=Name --tag-value=wal --attach-as=xvdg --mount-point=/data/wal --create-size=20 --create-name=wal --create-volume-type=standard --create-tags=team=db",
+	}, intPtr(1))
+
+	assert.NoError(t, err)
+	assert.Len(t, cfgs, 2)
+	assert.Equal(t, "xvdf", *cfgs[0].attachAs)
+	assert.Equal(t, "/data", *cfgs[0].mountPoint)
+	assert.Equal(t, int64(16384), *cfgs[0].mkfsInodeRatio)
+	assert.Equal(t, "/data/wal", *cfgs[1].mountPoint)
+	assert.Equal(t, int64(20), *cfgs[1].createSize)
+	assert.Equal(t, map[string]string{"team": "db"}, *cfgs[1].createTags)
+}
+
+func TestParseVolumeSpecWithQuotedValues(t *testing.T) {
+	cfg, err := parseVolumeSpec(`--tag-key=Name --tag-value="my data" --attach-as=xvdf --mount-point='/mnt/my data' --mount-options=noatime\,nodev --create-size=10 --create-name=data --create-volume-type=gp2 --create-tags="team=db \"ops\""`, intPtr(1))
+
+	assert.NoError(t, err)
+	assert.Equal(t, "my data", *cfg.tagValue)
+	assert.Equal(t, "/mnt/my data", *cfg.mountPoint)
+	assert.Equal(t, "noatime,nodev", *cfg.mountOptions)
+	assert.Equal(t, map[string]string{"team": `db "ops"`}, *cfg.createTags)
+}
+
+func TestSplitArgsRejectsUnterminatedQuote(t *testing.T) {
+	_, err := splitArgs(`--tag-value="my data`)
+
+	assert.Error(t, err)
+}
+
+func TestParseVolumeSpecsRejectsInvalidVolume(t *testing.T) {
+	_, err := parseVolumeSpecs("", []string{"--tag-key=Name --tag-value=data"}, intPtr(1))
+
+	assert.Error(t, err)
+}
+
+func TestAttachVolumesContinuesAfterFailure(t *testing.T) {
+	first := newConfig()
+	first.mountPoint = strPtr("/a")
+	second := newConfig()
+	second.mountPoint = strPtr("/b")
+	fakeAsgEbs := NewFakeAsgEbs(nil)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("describeVolume", mock.AnythingOfType("string")).
+		Return(&ec2.Volume{Size: aws.Int64(200)}, nil)
+	fakeAsgEbs.
+		On("volumeTags", mock.AnythingOfType("string")).
+		Return(map[string]string{fileSystemTypeTag: "ext4"}, nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), "/a", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(errors.New("mount failed"))
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), "/b", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAttachVolumes(fakeAsgEbs, []Config{*first, *second})
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", "/a", "ext4", "")
+	fakeAsgEbs.AssertCalled(t, "mountVolume", "/dev/xvdc", "/b", "ext4", "")
+}
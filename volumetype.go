@@ -0,0 +1,93 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+)
+
+// VolumeType describes the size, IOPS and throughput limits of an EBS volume
+// type. Types without MaxIops or MaxThroughput don't support provisioning
+// them.
+type VolumeType struct {
+	MinSize              int64
+	MaxSize              int64
+	IopsRequired         bool
+	MinIops              int64
+	MaxIops              int64
+	MaxIopsPerGiB        int64
+	MinThroughput        int64
+	MaxThroughput        int64
+	MaxThroughputPerIops float64
+}
+
+var volumeTypes = map[string]VolumeType{
+	"standard": {MinSize: 1, MaxSize: 1024},
+	"gp2":      {MinSize: 1, MaxSize: 16384},
+	"gp3": {
+		MinSize: 1, MaxSize: 16384,
+		MinIops: 3000, MaxIops: 16000, MaxIopsPerGiB: 500,
+		MinThroughput: 125, MaxThroughput: 1000, MaxThroughputPerIops: 0.25,
+	},
+	"io1": {
+		MinSize: 4, MaxSize: 16384,
+		IopsRequired: true, MinIops: 100, MaxIops: 64000, MaxIopsPerGiB: 50,
+	},
+	"io2": {
+		MinSize: 4, MaxSize: 65536,
+		IopsRequired: true, MinIops: 100, MaxIops: 256000, MaxIopsPerGiB: 1000,
+	},
+	"st1": {MinSize: 125, MaxSize: 16384},
+	"sc1": {MinSize: 125, MaxSize: 16384},
+}
+
+func volumeTypeNames() []string {
+	names := []string{}
+	for name := range volumeTypes {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// validateVolumeType checks the size, IOPS and throughput of a new volume
+// against the limits of its type.
+func validateVolumeType(name string, size int64, options VolumeOptions) error {
+	volumeType, ok := volumeTypes[name]
+	if !ok {
+		return fmt.Errorf("unknown volume type %s", name)
+	}
+
+	if size < volumeType.MinSize || size > volumeType.MaxSize {
+		return fmt.Errorf("%s volumes must be between %d and %d GiB, got %d", name, volumeType.MinSize, volumeType.MaxSize, size)
+	}
+
+	iops := options.Iops
+	switch {
+	case volumeType.MaxIops == 0 && iops > 0:
+		return fmt.Errorf("%s volumes don't support provisioned IOPS", name)
+	case volumeType.IopsRequired && iops == 0:
+		return fmt.Errorf("%s volumes require --iops", name)
+	case iops > 0 && (iops < volumeType.MinIops || iops > volumeType.MaxIops):
+		return fmt.Errorf("%s volumes support between %d and %d IOPS, got %d", name, volumeType.MinIops, volumeType.MaxIops, iops)
+	case iops > volumeType.MinIops && iops > size*volumeType.MaxIopsPerGiB:
+		return fmt.Errorf("%s volumes support at most %d IOPS per GiB, got %d IOPS for %d GiB", name, volumeType.MaxIopsPerGiB, iops, size)
+	}
+
+	throughput := options.Throughput
+	if throughput == 0 {
+		return nil
+	}
+	if volumeType.MaxThroughput == 0 {
+		return fmt.Errorf("%s volumes don't support provisioned throughput", name)
+	}
+	if throughput < volumeType.MinThroughput || throughput > volumeType.MaxThroughput {
+		return fmt.Errorf("%s volumes support between %d and %d MiB/s, got %d", name, volumeType.MinThroughput, volumeType.MaxThroughput, throughput)
+	}
+	if iops == 0 {
+		iops = volumeType.MinIops
+	}
+	if float64(throughput) > float64(iops)*volumeType.MaxThroughputPerIops {
+		return fmt.Errorf("%s volumes support at most %g MiB/s per IOPS, got %d MiB/s for %d IOPS", name, volumeType.MaxThroughputPerIops, throughput, iops)
+	}
+	return nil
+}
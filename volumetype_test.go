@@ -0,0 +1,103 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/mock"
+)
+
+func TestValidateVolumeType(t *testing.T) {
+	tests := []struct {
+		volumeType string
+		size       int64
+		iops       int64
+		throughput int64
+		valid      bool
+	}{
+		{"standard", 100, 0, 0, true},
+		{"standard", 2000, 0, 0, false},
+		{"standard", 100, 100, 0, false},
+		{"gp2", 100, 0, 0, true},
+		{"gp2", 100, 300, 0, false},
+		{"gp2", 100, 0, 125, false},
+		{"gp3", 1, 0, 0, true},
+		{"gp3", 1, 3000, 125, true},
+		{"gp3", 100, 16000, 1000, true},
+		{"gp3", 10, 6000, 0, false},
+		{"gp3", 100, 2000, 0, false},
+		{"gp3", 100, 0, 1000, false},
+		{"gp3", 100, 4000, 1000, true},
+		{"gp3", 100, 0, 2000, false},
+		{"io1", 100, 5000, 0, true},
+		{"io1", 100, 0, 0, false},
+		{"io1", 100, 6000, 0, false},
+		{"io1", 2, 100, 0, false},
+		{"io1", 100, 5000, 125, false},
+		{"io2", 100, 100000, 0, true},
+		{"io2", 100, 0, 0, false},
+		{"io2", 100, 200000, 0, false},
+		{"st1", 500, 0, 0, true},
+		{"st1", 100, 0, 0, false},
+		{"st1", 500, 500, 0, false},
+		{"sc1", 500, 0, 0, true},
+		{"sc1", 500, 0, 250, false},
+		{"io3", 100, 0, 0, false},
+	}
+
+	for _, test := range tests {
+		err := validateVolumeType(test.volumeType, test.size, VolumeOptions{Iops: test.iops, Throughput: test.throughput})
+		if test.valid {
+			assert.NoError(t, err, "%+v", test)
+		} else {
+			assert.Error(t, err, "%+v", test)
+		}
+	}
+}
+
+func TestCreateProvisionedIopsVolume(t *testing.T) {
+	cfg := newConfig()
+	cfg.createVolumeType = strPtr("gp3")
+	cfg.iops = int64Ptr(6000)
+	cfg.throughput = int64Ptr(500)
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	fakeAsgEbs.
+		On("findVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil, nil)
+	fakeAsgEbs.
+		On("createVolume", mock.AnythingOfType("int64"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("map[string]string"), mock.AnythingOfType("*string"), mock.AnythingOfType("main.VolumeOptions")).
+		Return(defaultVolumeId, nil)
+	fakeAsgEbs.
+		On("waitUntilVolumeAvailable", mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("attachVolume", defaultVolumeId, mock.AnythingOfType("string"), mock.AnythingOfType("bool")).
+		Return(nil)
+	fakeAsgEbs.
+		On("makeFileSystem", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("[]string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("mountVolume", mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string"), mock.AnythingOfType("string")).
+		Return(nil)
+	fakeAsgEbs.
+		On("tagVolume", mock.AnythingOfType("string"), map[string]string{mountOptionsTag: "defaults"}).
+		Return(nil)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.NoError(t, err)
+	fakeAsgEbs.AssertCalled(t, "createVolume", *cfg.createSize, *cfg.createName, "gp3", *cfg.createTags, (*string)(nil), VolumeOptions{Iops: 6000, Throughput: 500})
+}
+
+func TestRejectInvalidVolumeTypeBeforeApiCalls(t *testing.T) {
+	cfg := newConfig()
+	cfg.createVolumeType = strPtr("io1")
+	fakeAsgEbs := NewFakeAsgEbs(cfg)
+
+	err := runAsgEbs(fakeAsgEbs, *cfg)
+
+	assert.Error(t, err)
+	fakeAsgEbs.AssertNumberOfCalls(t, "findVolume", 0)
+	fakeAsgEbs.AssertNumberOfCalls(t, "createVolume", 0)
+}
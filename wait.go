@@ -0,0 +1,50 @@
+package main
+
+import (
+	"time"
+
+	log "github.com/Sirupsen/logrus"
+)
+
+const (
+	minPollInterval = 100 * time.Millisecond
+	maxPollInterval = 5 * time.Second
+)
+
+// waitFor calls check until it succeeds or the timeout expires. It checks
+// again whenever something changes in the watched directories, and polls
+// with an increasing interval in case a change goes unnoticed or watching is
+// not supported.
+func waitFor(check func() bool, dirs []string, timeout time.Duration) bool {
+	if check() {
+		return true
+	}
+
+	changes, stop, err := watchDirs(dirs)
+	if err != nil {
+		log.WithFields(log.Fields{"error": err, "dirs": dirs}).Info("Cannot watch for devices, polling instead")
+	} else {
+		defer stop()
+	}
+
+	deadline := time.After(timeout)
+	interval := minPollInterval
+	for {
+		poll := time.NewTimer(interval)
+		select {
+		case <-changes:
+			poll.Stop()
+		case <-poll.C:
+			interval *= 2
+			if interval > maxPollInterval {
+				interval = maxPollInterval
+			}
+		case <-deadline:
+			poll.Stop()
+			return check()
+		}
+		if check() {
+			return true
+		}
+	}
+}
@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// watchDirs reports changes to the entries of the given directories via
+// inotify. Directories which do not exist yet are skipped.
+func watchDirs(dirs []string) (<-chan struct{}, func(), error) {
+	fd, err := syscall.InotifyInit1(syscall.IN_CLOEXEC | syscall.IN_NONBLOCK)
+	if err != nil {
+		return nil, nil, err
+	}
+	watched := 0
+	err = errors.New("no directory to watch")
+	for _, dir := range dirs {
+		if _, watchErr := syscall.InotifyAddWatch(fd, dir, syscall.IN_CREATE|syscall.IN_MOVED_TO|syscall.IN_ATTRIB); watchErr != nil {
+			err = watchErr
+		} else {
+			watched++
+		}
+	}
+	if watched == 0 {
+		syscall.Close(fd)
+		return nil, nil, err
+	}
+
+	// A non-blocking file is handled by the runtime poller, so Close wakes
+	// up the pending Read.
+	file := os.NewFile(uintptr(fd), "inotify")
+	changes := make(chan struct{}, 1)
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			if _, err := file.Read(buf); err != nil {
+				return
+			}
+			select {
+			case changes <- struct{}{}:
+			default:
+			}
+		}
+	}()
+	return changes, func() { file.Close() }, nil
+}
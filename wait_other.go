@@ -0,0 +1,10 @@
+//go:build !linux
+// +build !linux
+
+package main
+
+import "errors"
+
+func watchDirs(dirs []string) (<-chan struct{}, func(), error) {
+	return nil, nil, errors.New("watching directories is only supported on Linux")
+}
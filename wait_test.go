@@ -0,0 +1,67 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func fileExists(path string) func() bool {
+	return func() bool {
+		_, err := os.Stat(path)
+		return err == nil
+	}
+}
+
+func TestWaitForCreatedFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wait")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "xvdc")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(file, []byte{}, 0644)
+	}()
+
+	assert.True(t, waitFor(fileExists(file), []string{dir}, 10*time.Second))
+}
+
+func TestWaitForPollsUnwatchableDirs(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wait")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "xvdc")
+
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ioutil.WriteFile(file, []byte{}, 0644)
+	}()
+
+	assert.True(t, waitFor(fileExists(file), []string{filepath.Join(dir, "missing")}, 10*time.Second))
+}
+
+func TestWaitForTimesOut(t *testing.T) {
+	dir, err := ioutil.TempDir("", "wait")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+
+	start := time.Now()
+	assert.False(t, waitFor(fileExists(filepath.Join(dir, "xvdc")), []string{dir}, 300*time.Millisecond))
+	assert.True(t, time.Since(start) < 5*time.Second)
+}
+
+func TestVolumeDeviceTimeoutReportsCheckedPaths(t *testing.T) {
+	root, cleanup := withFakeDevices(t)
+	defer cleanup()
+
+	_, err := (&AwsAsgEbs{}).volumeDevice("vol-0123456789abcdef0", "xvdc", 100*time.Millisecond)
+
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), filepath.Join(root, "dev/disk/by-id/nvme-Amazon_Elastic_Block_Store_vol0123456789abcdef0"))
+	assert.Contains(t, err.Error(), filepath.Join(root, "dev/xvdc"))
+}